@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+/*
+storeEvents picks the store 0 clickstream rows of the hosts in $1: the events
+sent from those hosts and every event of a device that sent one of them, since
+only page views are sure to carry $host.
+*/
+const storeEvents = `store = 0 AND (has($1, JSONExtractString(properties, '$host'))
+		OR (device_id != '' AND device_id IN (
+			SELECT device_id FROM Clickstream
+			WHERE store = 0 AND has($1, JSONExtractString(properties, '$host')))))`
+
+/*
+backfillClickstream gives the clickstream rows the store key migration left at
+store 0 back to their store, matching their host to the domains of each store
+in postgres. The rows are copied with the store and then deleted, the sorting
+key can't be updated in place. Running it again is safe, rows copied twice
+share a sorting key and are merged away.
+*/
+func backfillClickstream(pg *sql.DB, ch *sql.DB) error {
+	rows, err := pg.Query(`SELECT id, name, url FROM store ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type store struct {
+		id    int
+		hosts []string
+	}
+	stores := []store{}
+	for rows.Next() {
+		var id int
+		var name, u string
+		if err = rows.Scan(&id, &name, &u); err != nil {
+			rows.Close()
+			return err
+		}
+		stores = append(stores, store{id, storeHosts(name, u)})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	/* the deletes finish before the next store is copied */
+	ctx := clickhouse.Context(context.Background(), clickhouse.WithSettings(clickhouse.Settings{
+		"mutations_sync": 2,
+	}))
+	for _, s := range stores {
+		var n uint64
+		err = ch.QueryRowContext(ctx, `SELECT count() FROM Clickstream WHERE `+storeEvents, s.hosts).Scan(&n)
+		if err != nil {
+			return fmt.Errorf("store %d: %w", s.id, err)
+		}
+		if n == 0 {
+			continue
+		}
+
+		stmt := `INSERT INTO Clickstream (uuid, store, device_id, event, properties, timestamp)
+				 SELECT uuid, $2, device_id, event, properties, timestamp
+				 FROM Clickstream WHERE ` + storeEvents
+		if _, err = ch.ExecContext(ctx, stmt, s.hosts, s.id); err != nil {
+			return fmt.Errorf("store %d: %w", s.id, err)
+		}
+		stmt = `ALTER TABLE Clickstream DELETE WHERE ` + storeEvents
+		if _, err = ch.ExecContext(ctx, stmt, s.hosts); err != nil {
+			return fmt.Errorf("store %d: %w", s.id, err)
+		}
+		fmt.Printf("clickhouse: moved %d clickstream events to store %d\n", n, s.id)
+	}
+
+	var left uint64
+	if err = ch.QueryRow(`SELECT count() FROM Clickstream WHERE store = 0`).Scan(&left); err != nil {
+		return err
+	}
+	fmt.Printf("clickhouse: %d clickstream events match no store and stay at store 0\n", left)
+	return nil
+}
+
+/* storeHosts returns the hostnames a store's events can come from, with and without www. */
+func storeHosts(name string, u string) []string {
+	hosts := []string{}
+	add := func(h string) {
+		h = strings.TrimPrefix(strings.ToLower(h), "www.")
+		if h != "" {
+			hosts = append(hosts, h, "www."+h)
+		}
+	}
+	add(name)
+	if u != "" && !strings.Contains(u, "://") {
+		u = "https://" + u
+	}
+	if parsed, err := url.Parse(u); err == nil {
+		add(parsed.Hostname())
+	}
+	return hosts
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/driver"
+	"github.com/malalwan/slaash/internal/migrate"
+)
+
+const usage = `usage: migrate [flags] command
+
+commands:
+  up [n]         apply pending migrations, all of them or the next n
+  down [n]       roll back the last n applied migrations, 1 by default
+  status         list migrations and whether they were applied
+  create <name>  write empty up and down files for a new migration
+  backfill-clickstream
+                 give clickstream events from before the store key their store
+
+flags:
+`
+
+/* the migrate command, runs migrations/<db> against postgres and clickhouse */
+func main() {
+	database := flag.String("db", "all", "database to migrate: postgres, clickhouse or all")
+	dir := flag.String("dir", "migrations", "directory holding the postgres and clickhouse migration directories")
+	postgresDSN := flag.String("postgres", os.Getenv("DATABASE_URL"), "postgres connection string, $DATABASE_URL or the settings by default")
+	clickhouseDSN := flag.String("clickhouse", os.Getenv("CLICKHOUSE_URL"), "clickhouse connection string, $CLICKHOUSE_URL or the settings by default")
+	profile := flag.String("env", os.Getenv("SLAASH_ENV"), "settings profile used when no connection string is given")
+	configFile := flag.String("config", os.Getenv("SLAASH_CONFIG"), "settings file, "+config.DefaultFile+" if it exists")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command, args := flag.Arg(0), flag.Args()[1:]
+
+	databases := []string{*database}
+	if *database == "all" {
+		databases = []string{"postgres", "clickhouse"}
+	}
+
+	/* create only touches files, so it needs no connection */
+	if command == "create" {
+		if len(args) != 1 || *database == "all" {
+			log.Fatal("create needs -db postgres or -db clickhouse and a name")
+		}
+		paths, err := migrate.Create(filepath.Join(*dir, *database), args[0], time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range paths {
+			fmt.Println("Created", p)
+		}
+		return
+	}
+
+	if command != "up" && command != "down" && command != "status" && command != "backfill-clickstream" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	n := 0
+	if command == "down" {
+		n = 1
+	}
+	if len(args) > 0 {
+		var err error
+		n, err = strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			log.Fatalf("%s takes a positive number of migrations, not %q", command, args[0])
+		}
+	}
+
+	/* without connection strings the databases are the ones the app uses */
+	if *postgresDSN == "" || *clickhouseDSN == "" {
+		settings, err := config.LoadSettings(*profile, *configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *postgresDSN == "" {
+			*postgresDSN = settings.PostgresDSN()
+		}
+		if *clickhouseDSN == "" {
+			*clickhouseDSN = settings.ClickhouseDSN()
+		}
+	}
+
+	/* the backfill reads the stores from postgres and moves rows in clickhouse */
+	if command == "backfill-clickstream" {
+		pg, err := driver.ConnectSQL(*postgresDSN)
+		if err != nil {
+			log.Fatalf("cannot connect to postgres: %v", err)
+		}
+		ch, err := driver.ConnectClickhouse(*clickhouseDSN)
+		if err != nil {
+			log.Fatalf("cannot connect to clickhouse: %v", err)
+		}
+		err = backfillClickstream(pg.SQL, ch.SQL)
+		pg.SQL.Close()
+		ch.SQL.Close()
+		if err != nil {
+			log.Fatalf("clickhouse: %v", err)
+		}
+		return
+	}
+
+	for _, name := range databases {
+		m, err := connect(name, *postgresDSN, *clickhouseDSN, filepath.Join(*dir, name))
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = runCommand(m, name, command, n)
+		m.DB.Close()
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+	}
+}
+
+/* connect opens the named database and returns its migrator */
+func connect(name, postgresDSN, clickhouseDSN, dir string) (*migrate.Migrator, error) {
+	var db *driver.DB
+	var err error
+	switch name {
+	case "postgres":
+		db, err = driver.ConnectSQL(postgresDSN)
+	case "clickhouse":
+		db, err = driver.ConnectClickhouse(clickhouseDSN)
+	default:
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %w", name, err)
+	}
+	return migrate.New(name, db.SQL, dir)
+}
+
+/* runCommand runs up, down or status against one database and prints what it did */
+func runCommand(m *migrate.Migrator, name, command string, n int) error {
+	switch command {
+	case "up":
+		done, err := m.Up(n)
+		for _, mg := range done {
+			fmt.Printf("%s: applied %d_%s\n", name, mg.Version, mg.Name)
+		}
+		if err == nil && len(done) == 0 {
+			fmt.Printf("%s: up to date\n", name)
+		}
+		return err
+	case "down":
+		done, err := m.Down(n)
+		for _, mg := range done {
+			fmt.Printf("%s: rolled back %d_%s\n", name, mg.Version, mg.Name)
+		}
+		if errors.Is(err, migrate.ErrNoMigrations) {
+			fmt.Printf("%s: nothing to roll back\n", name)
+			return nil
+		}
+		return err
+	case "status":
+		ms, err := m.Status()
+		if err != nil {
+			return err
+		}
+		for _, mg := range ms {
+			state := "pending"
+			if mg.Applied {
+				state = "applied"
+			}
+			fmt.Printf("%s: %-8s %d_%s\n", name, state, mg.Version, mg.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/gob"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"time"
+	_ "time/tzdata" // store timezones must load on hosts without a zone database
 
 	_ "github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/alexedwards/scs/v2"
@@ -15,16 +17,14 @@ import (
 	"github.com/malalwan/slaash/internal/handlers"
 	"github.com/malalwan/slaash/internal/helpers"
 	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/secrets"
 )
 
-const portNumber = ":8080"
-
 var app config.AppConfig
 var session *scs.SessionManager
 var infoLog *log.Logger
 var errorLog *log.Logger
-var postgresCreds driver.DBCreds
-var clickhouseCreds driver.DBCreds
+var settings config.Settings
 
 /* the main function */
 func main() {
@@ -34,10 +34,10 @@ func main() {
 	}
 	defer db.SQL.Close()
 
-	app.InfoLog.Printf("Staring application on port %s", portNumber)
+	app.InfoLog.Printf("Staring application on port %s", settings.Port)
 
 	srv := &http.Server{
-		Addr:    portNumber,
+		Addr:    settings.Port,
 		Handler: routes(&app),
 	}
 
@@ -50,33 +50,46 @@ func main() {
 /*
 	Function to set up all global entities:
 
-1. AppConfig
-2. PostgresDB Config
-3. Clickhouse Config
+1. Settings, from the profile's section of the config file and the environment
+2. AppConfig
+3. PostgresDB Config
+4. Clickhouse Config
 */
 func run() (*driver.DB, error) {
+	profile := flag.String("env", os.Getenv("SLAASH_ENV"), "settings profile: development, test or production")
+	configFile := flag.String("config", os.Getenv("SLAASH_CONFIG"), "settings file, "+config.DefaultFile+" if it exists")
+	flag.Parse()
+
 	/* what am I going to put in the session? */
 	gob.Register(models.Users{})
 
-	/* to pick different DBs for test and prod and secure cookies */
-	app.InProduction = false
-
-	if app.InProduction {
-		app.MyAppCreds = []string{"7f4b95c01d4764f01cb658adfad31108", "54bb5ac2cbf15a6d6bdb8bdeafec00f6"}
-		app.MyScopes = []string{"dd", "bb"} // to be edited
-		app.RedirectURL = "dashboard.slaash.it"
-	} else {
-		app.MyAppCreds = []string{"5e5ce46a1dfdf20f90f07016293f3838", "045f0b1fc37793af68f5bce04c9e2b63"}
-		app.MyScopes = []string{"dd", "bb"}
-		app.RedirectURL = "dashboard.slaash.it"
-	}
-
 	/* initializing loggers */
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
 	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app.ErrorLog = errorLog
 
+	var err error
+	settings, err = config.LoadSettings(*profile, *configFile)
+	if err != nil {
+		return nil, err
+	}
+	app.InfoLog.Println("Loaded settings:", settings)
+
+	/* to pick different DBs for test and prod and secure cookies */
+	app.InProduction = settings.InProduction
+	app.MyAppCreds = []string{settings.Shopify.ApiKey, settings.Shopify.ApiSecret}
+	app.MyScopes = settings.Shopify.Scopes
+	app.RedirectURL = settings.Shopify.RedirectURL
+	app.WebhookURL = settings.Shopify.WebhookURL
+	app.StorefrontURL = settings.Shopify.StorefrontURL
+	app.AnalyticsBackend = settings.AnalyticsBackend
+	app.ClickstreamSpool = settings.ClickstreamSpool
+	app.Tokens, err = secrets.NewKeyring(settings.TokenKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	/* session to monitor logged in user */
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -87,48 +100,31 @@ func run() (*driver.DB, error) {
 	/* push the session to global app config for easy access */
 	app.Session = session
 
-	/* Init postgres creds */
-	postgresCreds.Host = "pg-slaash-slaash-01.aivencloud.com"
-	postgresCreds.Port = 19236
-	postgresCreds.Username = "avnadmin"
-	postgresCreds.Password = "AVNS__o7qCttikmfMMABdM7J"
 	app.InfoLog.Println("Connecting to Database")
-	var dbname string
-	if app.InProduction {
-		dbname = "dashboard"
-	} else {
-		dbname = "defaultdb"
-	}
-
-	connString := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s",
-		postgresCreds.Host, postgresCreds.Port, dbname,
-		postgresCreds.Username, postgresCreds.Password)
-	db, err := driver.ConnectSQL(connString)
+	db, err := driver.ConnectSQL(settings.PostgresDSN())
 	if err != nil {
-		log.Fatal("Cannot connect to postgres database! Dying...")
+		return nil, fmt.Errorf("cannot connect to postgres database: %w", err)
 	}
 	app.InfoLog.Println("Connected to postgres database!")
 
-	/* Init clickhouse creds */
-	clickhouseCreds.Host = "clickhouse-slaash-01-slaash-01.aivencloud.com"
-	clickhouseCreds.Port = 19237
-	clickhouseCreds.Username = "avnadmin"
-	clickhouseCreds.Password = "AVNS_vqSF_mM4PoCemxvdn7H"
-
-	clickhouseString := fmt.Sprintf("https://%s:%d?username=%s&password=%s&secure",
-		clickhouseCreds.Host, clickhouseCreds.Port,
-		clickhouseCreds.Username, clickhouseCreds.Password)
-	clickhouse, err := driver.ConnectClickhouse(clickhouseString)
+	clickhouse, err := driver.ConnectClickhouse(settings.ClickhouseDSN())
 	if err != nil {
-		log.Fatal("Cannot connect to clickhouse database! Dying...")
+		return nil, fmt.Errorf("cannot connect to clickhouse database: %w", err)
 	}
 	app.InfoLog.Println("Connected to clickhouse database!")
 
-	/* Set up globals for all packages */
-	repo := handlers.NewRepo(&app, db, clickhouse)
-	handlers.NewHandlers(repo)
+	/* Set up globals for all packages, before any worker can read them */
 	helpers.NewHelpers(&app)
 	models.NewShopifyFunctions(&app)
+	repo := handlers.NewRepo(&app, db, clickhouse)
+	handlers.NewHandlers(repo)
+	go repo.Codes.Run()
+	go repo.Themes.Run()
+	go repo.Collector.Run()
+	go runCampaignScheduler(repo.DB)
+	go runRollups(repo.DB)
+	go runAnalyticsSync(repo.Analytics)
+	go runTokenRotation(repo.DB)
 
 	return db, nil
 }
@@ -13,35 +13,56 @@ func routes(app *config.AppConfig) http.Handler {
 	mux := chi.NewRouter()
 
 	mux.Use(middleware.Recoverer)
-	mux.Use(NoSurf)
-	mux.Use(SessionLoad)
-	/* if !app.InProduction {
-		mux.Use(AddTestStoreToSession)
-	} */
-
-	mux.Get("/test", handlers.Repo.TestSession)           // Tests if the stack is stitched
-	mux.Get("/user/login", handlers.Repo.Login)           // login for a registered guy
-	mux.Get("/{loginAction}", handlers.Repo.ShopifyLogin) // api call for auth
-
-	mux.Route("/api", func(mux chi.Router) {
-		mux.Use(Auth)
-
-		mux.Get("/toggle_deal_list", handlers.Repo.ToggleDealList)                    // request to turn off deal list
-		mux.Get("/turn_off_next_campaign", handlers.Repo.TurnOffNextCampaign)         // turns off the campaign for next day only
-		mux.Get("/campaign_activity", handlers.Repo.GetCampaignActivity)              // api to send active campaign activity
-		mux.Get("/deallist_activity", handlers.Repo.GetDealListActivity)              // api to send overall deal list activity
-		mux.Get("/trending_products", handlers.Repo.GetTrendingProducts)              // trending products list (from campaign_product)
-		mux.Get("/otf_visitors", handlers.Repo.GetOtfVisitorData)                     // series data for otf visitors (should come from the agg DB)
-		mux.Get("/past_campaigns", handlers.Repo.GetAllCampaigns)                     // list of daily campaigns for a specific store
-		mux.Get("/discounts", handlers.Repo.GetAllDiscounts)                          //
-		mux.Get("/get_dl_info", handlers.Repo.GetDealListInfo)                        //
-		mux.Get("/get_user_profile", handlers.Repo.GetUserProfile)                    //
-		mux.Get("/config_discount_defaults", handlers.Repo.ConfigureDiscountDefaults) //
-		mux.Post("/config_discounts", handlers.Repo.ConfigureDiscounts)               // Configure discounts for a store
-		mux.Post("/config_dl", handlers.Repo.ConfigureDealList)                       // configure deal list properties for a store
-		mux.Post("/update_profile", handlers.Repo.UpdateUserProfile)                  // api to change user profile details
-		mux.Post("/update_password", handlers.Repo.UpdatePassword)                    // change dashboard password
-		mux.Get("/if_otf", handlers.Repo.GetOtfUserInfo)                              // Pulls clickstream, aggregates in Postgres, and uses otf algo
+
+	/* shopify webhooks are signed by shopify, no csrf token or session here */
+	mux.Post("/webhooks/{resource}/{event}", handlers.Repo.ShopifyWebhook)
+
+	/* deal list widget on the storefront, no csrf token or session here either */
+	mux.Route("/storefront", func(mux chi.Router) {
+		mux.Use(StorefrontAuth)
+
+		mux.Get("/otf", handlers.Repo.StorefrontOtf)                 // should the deal list be shown to this visitor
+		mux.Get("/deal_list", handlers.Repo.StorefrontDealList)      // deal list look and max discount
+		mux.Post("/reveal_code", handlers.Repo.StorefrontRevealCode) // issues the visitor's discount code
+		mux.Post("/event", handlers.Repo.StorefrontEvent)            // funnel steps: deal_shown, deal_clicked, code_copied
+		mux.Post("/collect", handlers.Repo.StorefrontCollect)        // batched clickstream events for OTF scoring
+	})
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(NoSurf)
+		mux.Use(SessionLoad)
+		/* if !app.InProduction {
+			mux.Use(AddTestStoreToSession)
+		} */
+
+		mux.Get("/test", handlers.Repo.TestSession)           // Tests if the stack is stitched
+		mux.Get("/user/login", handlers.Repo.Login)           // login for a registered guy
+		mux.Get("/{loginAction}", handlers.Repo.ShopifyLogin) // api call for auth
+
+		mux.Route("/api", func(mux chi.Router) {
+			mux.Use(Auth)
+
+			mux.Get("/toggle_deal_list", handlers.Repo.ToggleDealList)                    // request to turn off deal list
+			mux.Get("/turn_off_next_campaign", handlers.Repo.TurnOffNextCampaign)         // turns off the campaign for next day only
+			mux.Get("/campaign_activity", handlers.Repo.GetCampaignActivity)              // api to send active campaign activity
+			mux.Get("/deallist_activity", handlers.Repo.GetDealListActivity)              // api to send overall deal list activity
+			mux.Get("/trending_products", handlers.Repo.GetTrendingProducts)              // trending products list (from campaign_product)
+			mux.Get("/otf_visitors", handlers.Repo.GetOtfVisitorData)                     // series data for otf visitors (should come from the agg DB)
+			mux.Get("/past_campaigns", handlers.Repo.GetAllCampaigns)                     // list of daily campaigns for a specific store
+			mux.Get("/discounts", handlers.Repo.GetAllDiscounts)                          //
+			mux.Get("/get_dl_info", handlers.Repo.GetDealListInfo)                        //
+			mux.Get("/get_user_profile", handlers.Repo.GetUserProfile)                    //
+			mux.Get("/config_discount_defaults", handlers.Repo.ConfigureDiscountDefaults) //
+			mux.Post("/config_discounts", handlers.Repo.ConfigureDiscounts)               // Configure discounts for a store
+			mux.Post("/config_dl", handlers.Repo.ConfigureDealList)                       // configure deal list properties for a store
+			mux.Post("/update_profile", handlers.Repo.UpdateUserProfile)                  // api to change user profile details
+			mux.Post("/update_password", handlers.Repo.UpdatePassword)                    // change dashboard password
+			mux.Get("/if_otf", handlers.Repo.GetOtfUserInfo)                              // Pulls clickstream, aggregates in Postgres, and uses otf algo
+			mux.Get("/get_otf_config", handlers.Repo.GetOtfConfig)                        // OTF threshold and signal weights for the store
+			mux.Post("/config_otf", handlers.Repo.ConfigureOtf)                           // tune OTF threshold and signal weights
+			mux.Get("/theme_deployments", handlers.Repo.GetThemeDeployments)              // history of slaash assets pushed to the theme
+			mux.Post("/theme_rollback", handlers.Repo.RollbackThemeDeployment)            // undo one push of a slaash asset
+		})
 	})
 
 	/* later for admin side login
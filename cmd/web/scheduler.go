@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+
+	"github.com/malalwan/slaash/internal/repository"
+)
+
+const schedulerInterval = time.Minute // how often renewal times are checked
+
+/*
+runCampaignScheduler opens every store's daily campaign at its renewal time
+and closes the previous one, it never returns. The first pass runs right away
+so campaigns missed while the app was down are opened on start. Several
+instances can run it, the database lets only one of them open a campaign.
+*/
+func runCampaignScheduler(db repository.DatabaseRepo) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		scheduleCampaigns(db, time.Now())
+		<-ticker.C
+	}
+}
+
+func scheduleCampaigns(db repository.DatabaseRepo, now time.Time) {
+	stores, err := db.GetInstalledStores()
+	if err != nil {
+		app.ErrorLog.Println("Scheduler failed to fetch stores:", err)
+		return
+	}
+	latest, err := db.GetLatestCampaignStarts()
+	if err != nil {
+		app.ErrorLog.Println("Scheduler failed to fetch campaigns:", err)
+		return
+	}
+
+	for _, store := range stores {
+		start := store.CampaignStart(now)
+		if last, found := latest[store.ID]; found && !last.Before(start) {
+			continue
+		}
+
+		opened, err := db.OpenCampaign(store.ID, start, start.AddDate(0, 0, 1))
+		if err != nil {
+			app.ErrorLog.Println("Failed to open campaign for", store.Name, err)
+			continue
+		}
+		if opened {
+			app.InfoLog.Println("Opened campaign for", store.Name, "at", start.Format(time.RFC3339))
+		}
+	}
+}
+
+const rollupInterval = time.Minute // how often dirty rollup hours are recomputed
+const rollupBatch = 500            // hours recomputed per statement
+
+/*
+runRollups keeps hourly_rollup up to date with visitor and checkout, it never
+returns. Each pass works through every hour marked dirty since the last one.
+*/
+func runRollups(db repository.DatabaseRepo) {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := db.RefreshRollups(rollupBatch)
+			if err != nil {
+				app.ErrorLog.Println("Failed to refresh rollups:", err)
+				break
+			}
+			if n < rollupBatch {
+				break
+			}
+		}
+		<-ticker.C
+	}
+}
+
+const analyticsSyncInterval = 10 * time.Second // how often changed rows are copied to the analytics backend
+const analyticsSyncBatch = 5000                // rows copied per table per pass
+
+/* runAnalyticsSync copies visitor and checkout changes to the analytics backend, it never returns */
+func runAnalyticsSync(a repository.AnalyticsRepo) {
+	ticker := time.NewTicker(analyticsSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := a.Sync(analyticsSyncBatch)
+			if err != nil {
+				app.ErrorLog.Println("Failed to sync analytics:", err)
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+		<-ticker.C
+	}
+}
+
+const tokenRotationInterval = 10 * time.Minute // how often tokens sealed with an old key are looked for
+const tokenRotationBatch = 100                 // stores rotated per transaction
+
+/*
+runTokenRotation re-seals shopify tokens stored in plaintext or under an old
+key with the primary key, it never returns. After a new key is put first in
+token_keys, the old one can be dropped once no token is sealed with it.
+*/
+func runTokenRotation(db repository.DatabaseRepo) {
+	ticker := time.NewTicker(tokenRotationInterval)
+	defer ticker.Stop()
+
+	for {
+		/* stores that failed stay behind the cursor until the next tick */
+		total, after := 0, 0
+		for {
+			n, last, err := db.RotateStoreTokens(after, tokenRotationBatch)
+			if err != nil {
+				app.ErrorLog.Println("Failed to rotate store tokens:", err)
+				break
+			}
+			total += n
+			if last == 0 {
+				break
+			}
+			after = last
+		}
+		if total > 0 {
+			app.InfoLog.Println("Rotated the tokens of", total, "stores")
+		}
+		<-ticker.C
+	}
+}
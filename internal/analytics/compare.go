@@ -0,0 +1,50 @@
+package analytics
+
+import (
+	"time"
+
+	"github.com/malalwan/slaash/internal/models"
+)
+
+// Totals returns named metric totals of a store over [from, to)
+type Totals func(id int, from time.Time, to time.Time) (map[string]int, error)
+
+/*
+Compare runs every totals query over the window of q and over its comparison
+period, and pairs up each metric. Metrics missing from a period count as 0.
+*/
+func Compare(q models.AnalyticsQuery, id int, totals ...Totals) (map[string]models.Comparison, error) {
+	res := make(map[string]models.Comparison)
+	for _, t := range totals {
+		current, err := t(id, q.From, q.To)
+		if err != nil {
+			return nil, err
+		}
+		previous, err := t(id, q.CompareFrom, q.CompareTo)
+		if err != nil {
+			return nil, err
+		}
+		for name, v := range current {
+			res[name] = NewComparison(v, previous[name])
+		}
+		for name, v := range previous {
+			if _, found := current[name]; !found {
+				res[name] = NewComparison(0, v)
+			}
+		}
+	}
+	return res, nil
+}
+
+// NewComparison pairs a current and previous value, the change is 0 when there was nothing before
+func NewComparison(current int, previous int) models.Comparison {
+	c := models.Comparison{
+		Current:  current,
+		Previous: previous,
+		Up:       current >= previous,
+	}
+	if previous != 0 {
+		c.Change = float32(current-previous) / float32(previous) * 100
+	}
+	return c
+}
@@ -0,0 +1,99 @@
+package analytics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/malalwan/slaash/internal/models"
+)
+
+func TestNewComparison(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  int
+		previous int
+		want     models.Comparison
+	}{
+		{"increase", 150, 100, models.Comparison{Current: 150, Previous: 100, Change: 50, Up: true}},
+		{"decrease", 50, 200, models.Comparison{Current: 50, Previous: 200, Change: -75, Up: false}},
+		{"unchanged", 80, 80, models.Comparison{Current: 80, Previous: 80, Change: 0, Up: true}},
+		{"zero previous", 40, 0, models.Comparison{Current: 40, Previous: 0, Change: 0, Up: true}},
+		{"both zero", 0, 0, models.Comparison{Current: 0, Previous: 0, Change: 0, Up: true}},
+		{"drop to zero", 0, 30, models.Comparison{Current: 0, Previous: 30, Change: -100, Up: false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewComparison(tt.current, tt.previous); got != tt.want {
+				t.Errorf("NewComparison(%d, %d) = %+v, want %+v", tt.current, tt.previous, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	q := models.AnalyticsQuery{
+		From:        day,
+		To:          day.AddDate(0, 0, 1),
+		CompareFrom: day.AddDate(0, 0, -1),
+		CompareTo:   day,
+		Granularity: "hour",
+		Location:    time.UTC,
+	}
+
+	/* each period has a metric the other one lacks */
+	checkouts := func(id int, from time.Time, to time.Time) (map[string]int, error) {
+		switch {
+		case from.Equal(q.From) && to.Equal(q.To):
+			return map[string]int{"gmv": 300, "conversions": 4}, nil
+		case from.Equal(q.CompareFrom) && to.Equal(q.CompareTo):
+			return map[string]int{"gmv": 200, "discount": 50}, nil
+		}
+		t.Fatalf("unexpected window %v - %v", from, to)
+		return nil, nil
+	}
+	visitors := func(id int, from time.Time, to time.Time) (map[string]int, error) {
+		if id != 7 {
+			t.Errorf("store %d, want 7", id)
+		}
+		if from.Equal(q.From) {
+			return map[string]int{"users": 10}, nil
+		}
+		return map[string]int{"users": 0}, nil
+	}
+
+	got, err := Compare(q, 7, checkouts, visitors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]models.Comparison{
+		"gmv":         {Current: 300, Previous: 200, Change: 50, Up: true},
+		"conversions": {Current: 4, Previous: 0, Change: 0, Up: true},
+		"discount":    {Current: 0, Previous: 50, Change: -100, Up: false},
+		"users":       {Current: 10, Previous: 0, Change: 0, Up: true},
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d metrics, want %d: %+v", len(got), len(want), got)
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s = %+v, want %+v", name, got[name], w)
+		}
+	}
+}
+
+func TestCompareError(t *testing.T) {
+	q := models.AnalyticsQuery{From: time.Unix(100, 0), To: time.Unix(200, 0), CompareFrom: time.Unix(0, 0), CompareTo: time.Unix(100, 0)}
+	failed := errors.New("query failed")
+	previousFails := func(id int, from time.Time, to time.Time) (map[string]int, error) {
+		if from.Equal(q.CompareFrom) {
+			return nil, failed
+		}
+		return map[string]int{"gmv": 1}, nil
+	}
+
+	if _, err := Compare(q, 1, previousFails); !errors.Is(err, failed) {
+		t.Errorf("err = %v, want %v", err, failed)
+	}
+}
@@ -0,0 +1,295 @@
+package collect
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/repository"
+)
+
+const MaxBatch = 500                  // events accepted in one request
+const maxBuffered = 50000             // events held in memory before requests are turned away
+const flushSize = 5000                // events written per insert, a full buffer is written right away
+const flushInterval = 2 * time.Second // how often the buffer is written
+const maxSpooled = 1000               // batch files kept on disk, the oldest is dropped past this
+const retryBatch = 10                 // spooled files retried per flush
+const maxString = 2048                // longest string property accepted
+const maxAge = 24 * time.Hour         // older events are refused
+const maxSkew = 5 * time.Minute       // how far in the future a client clock may be
+
+// ErrFull is returned when the buffer can't take a batch, the client should retry later
+var ErrFull = errors.New("clickstream buffer is full")
+
+/* kind of a property value, json numbers arrive as float64 */
+type kind int
+
+const (
+	text kind = iota
+	number
+)
+
+type field struct {
+	kind     kind
+	required bool
+}
+
+/* common properties are allowed on every event */
+var common = map[string]field{
+	"$device_id":  {text, true},
+	"$session_id": {text, false},
+	"$pathname":   {text, false},
+	"$host":       {text, false},
+}
+
+/* schema has the properties of each event besides the common ones */
+var schema = map[string]map[string]field{
+	"$pageview": {
+		"$pathname": {text, true},
+		"$host":     {text, true},
+		"$referrer": {text, false},
+	},
+	"$autocapture": {
+		"selector": {text, true},
+		"tag_name": {text, true},
+		"src":      {text, false},
+		"x":        {number, false},
+		"y":        {number, false},
+	},
+	"$scroll": {
+		"depth": {number, true},
+	},
+	"add_to_cart": {
+		"product_id": {text, true},
+		"quantity":   {number, false},
+	},
+}
+
+/*
+Validate checks a batch sent by the store against the schema, the first bad
+event fails the whole batch. Accepted events get a uuid, the store, their
+device id, and now as timestamp when they had none.
+*/
+func Validate(es []models.ClickEvent, store int, now time.Time) error {
+	for k := range es {
+		e := &es[k]
+		fields, found := schema[e.Event]
+		if !found {
+			return fmt.Errorf("event %d: unknown event %q", k, e.Event)
+		}
+		if err := validateProperties(e.Properties, fields); err != nil {
+			return fmt.Errorf("event %d (%s): %w", k, e.Event, err)
+		}
+		if e.Event == "$scroll" && (e.Properties["depth"].(float64) < 0 || e.Properties["depth"].(float64) > 100) {
+			return fmt.Errorf("event %d ($scroll): depth must be between 0 and 100", k)
+		}
+		if q, found := e.Properties["quantity"].(float64); found && (q < 1 || q != math.Trunc(q)) {
+			return fmt.Errorf("event %d (add_to_cart): quantity must be a positive integer", k)
+		}
+
+		if e.Timestamp.IsZero() {
+			e.Timestamp = now
+		}
+		if e.Timestamp.Before(now.Add(-maxAge)) || e.Timestamp.After(now.Add(maxSkew)) {
+			return fmt.Errorf("event %d (%s): timestamp out of range", k, e.Event)
+		}
+		e.UUID = uuid.NewString()
+		e.Store = store
+		e.DeviceID = e.Properties["$device_id"].(string)
+	}
+	return nil
+}
+
+/* validateProperties refuses missing, unknown and mistyped properties */
+func validateProperties(props map[string]interface{}, fields map[string]field) error {
+	for _, set := range []map[string]field{common, fields} {
+		for name, f := range set {
+			if _, found := props[name]; f.required && !found {
+				return fmt.Errorf("%s is required", name)
+			}
+		}
+	}
+	for name, v := range props {
+		f, found := fields[name]
+		if !found {
+			f, found = common[name]
+		}
+		if !found {
+			return fmt.Errorf("unknown property %s", name)
+		}
+		switch f.kind {
+		case text:
+			s, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("%s must be a string", name)
+			}
+			if len(s) > maxString {
+				return fmt.Errorf("%s is longer than %d", name, maxString)
+			}
+		case number:
+			n, ok := v.(float64)
+			if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+				return fmt.Errorf("%s must be a number", name)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Collector buffers clickstream events in memory and writes them to clickhouse in
+bulk. Batches clickhouse refuses go to a queue on disk and are retried.
+*/
+type Collector struct {
+	App     *config.AppConfig
+	DB      repository.ClickhouseRepo
+	Dir     string // where refused batches are queued
+	mu      sync.Mutex
+	pending []models.ClickEvent
+	flush   chan struct{}
+}
+
+// NewCollector creates the collector, Run must be started for events to be written
+func NewCollector(a *config.AppConfig, db repository.ClickhouseRepo, dir string) *Collector {
+	return &Collector{
+		App:   a,
+		DB:    db,
+		Dir:   dir,
+		flush: make(chan struct{}, 1),
+	}
+}
+
+// Add buffers a validated batch, all of it or none with ErrFull
+func (c *Collector) Add(es []models.ClickEvent) error {
+	c.mu.Lock()
+	if len(c.pending)+len(es) > maxBuffered {
+		c.mu.Unlock()
+		return ErrFull
+	}
+	c.pending = append(c.pending, es...)
+	full := len(c.pending) >= flushSize
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Run writes the buffer and retries the disk queue, it never returns
+func (c *Collector) Run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.flush:
+		case <-ticker.C:
+		}
+		if c.write() {
+			c.retry()
+		}
+	}
+}
+
+/* write empties the buffer into clickhouse, returns false if clickhouse refused */
+func (c *Collector) write() bool {
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mu.Unlock()
+
+	ok := true
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > flushSize {
+			n = flushSize
+		}
+		if err := c.DB.InsertClickstream(batch[:n]); err != nil {
+			c.App.ErrorLog.Println("Failed to write clickstream, queueing on disk:", err)
+			c.spool(batch[:n])
+			ok = false
+		}
+		batch = batch[n:]
+	}
+	return ok
+}
+
+/* spool queues a batch on disk, past maxSpooled the oldest batches are dropped */
+func (c *Collector) spool(batch []models.ClickEvent) {
+	err := os.MkdirAll(c.Dir, 0o755)
+	if err != nil {
+		c.App.ErrorLog.Println("Dropped", len(batch), "clickstream events:", err)
+		return
+	}
+	data, err := json.Marshal(batch)
+	if err != nil {
+		c.App.ErrorLog.Println("Dropped", len(batch), "clickstream events:", err)
+		return
+	}
+
+	/* written aside and renamed so retry never reads half a file */
+	name := filepath.Join(c.Dir, strconv.FormatInt(time.Now().UnixNano(), 10)+".json")
+	err = os.WriteFile(name+".tmp", data, 0o644)
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		c.App.ErrorLog.Println("Dropped", len(batch), "clickstream events:", err)
+		return
+	}
+
+	files := c.spooled()
+	for len(files) > maxSpooled {
+		c.App.ErrorLog.Println("Disk queue full, dropping", files[0])
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+/* retry writes the oldest queued batches, stopping at the first refusal */
+func (c *Collector) retry() {
+	files := c.spooled()
+	if len(files) > retryBatch {
+		files = files[:retryBatch]
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			c.App.ErrorLog.Println("Failed to read queued clickstream:", err)
+			continue
+		}
+		var batch []models.ClickEvent
+		if err = json.Unmarshal(data, &batch); err != nil {
+			c.App.ErrorLog.Println("Dropping unreadable clickstream batch", name, err)
+			os.Remove(name)
+			continue
+		}
+		if err = c.DB.InsertClickstream(batch); err != nil {
+			return
+		}
+		/* a batch written twice keeps its uuids and merges away in clickhouse */
+		os.Remove(name)
+		c.App.InfoLog.Println("Wrote", len(batch), "queued clickstream events")
+	}
+}
+
+/* spooled lists the queued batch files, oldest first */
+func (c *Collector) spooled() []string {
+	files, _ := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	sort.Strings(files)
+	return files
+}
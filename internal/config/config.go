@@ -4,15 +4,21 @@ import (
 	"log"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/malalwan/slaash/internal/secrets"
 )
 
 // AppConfig holds the application config
 type AppConfig struct {
-	InfoLog      *log.Logger
-	ErrorLog     *log.Logger
-	InProduction bool
-	Session      *scs.SessionManager
-	MyAppCreds   []string
-	MyScopes     []string
-	RedirectURL  string
+	InfoLog          *log.Logger
+	ErrorLog         *log.Logger
+	InProduction     bool
+	Session          *scs.SessionManager
+	MyAppCreds       []string
+	MyScopes         []string
+	RedirectURL      string
+	WebhookURL       string
+	StorefrontURL    string
+	AnalyticsBackend string           // postgres or clickhouse
+	ClickstreamSpool string           // directory of clickstream batches waiting to be retried
+	Tokens           *secrets.Keyring // seals shopify tokens stored in the database
 }
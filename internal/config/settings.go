@@ -0,0 +1,353 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/malalwan/slaash/internal/secrets"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Settings are what differs between deployments. They are read from a YAML file
+with one section per profile, then environment variables override single
+values, so secrets can stay out of the file altogether.
+*/
+type Settings struct {
+	Profile          string             `yaml:"-"`
+	Port             string             `yaml:"port"`
+	InProduction     bool               `yaml:"in_production"`
+	Postgres         PostgresSettings   `yaml:"postgres"`
+	Clickhouse       ClickhouseSettings `yaml:"clickhouse"`
+	Shopify          ShopifySettings    `yaml:"shopify"`
+	AnalyticsBackend string             `yaml:"analytics_backend"`
+	ClickstreamSpool string             `yaml:"clickstream_spool"`
+	TokenKeys        []string           `yaml:"token_keys"` // <id>:<base64 key>, the first seals new tokens
+}
+
+type PostgresSettings struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Database string `yaml:"database"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	SSLMode  string `yaml:"sslmode"` // disable, require, verify-full...
+}
+
+type ClickhouseSettings struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"` // http interface
+	Database string `yaml:"database"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Secure   bool   `yaml:"secure"` // https
+}
+
+type ShopifySettings struct {
+	ApiKey        string   `yaml:"api_key"`
+	ApiSecret     string   `yaml:"api_secret"`
+	Scopes        []string `yaml:"scopes"`
+	RedirectURL   string   `yaml:"redirect_url"`
+	WebhookURL    string   `yaml:"webhook_url"`
+	StorefrontURL string   `yaml:"storefront_url"`
+}
+
+// Profiles are the sections a settings file can have
+var Profiles = []string{"development", "test", "production"}
+
+// DefaultFile is read when no file is named and it exists
+const DefaultFile = "config.yml"
+
+const redacted = "[redacted]"
+
+/* defaults are the settings of a profile before the file and environment */
+func defaults(profile string) Settings {
+	s := Settings{
+		Profile:          profile,
+		Port:             ":8080",
+		AnalyticsBackend: "postgres",
+		ClickstreamSpool: "spool/clickstream",
+		Postgres: PostgresSettings{
+			Host:     "localhost",
+			Port:     5432,
+			Database: "slaash_" + profile,
+			User:     "postgres",
+			SSLMode:  "disable",
+		},
+		Clickhouse: ClickhouseSettings{
+			Host:     "localhost",
+			Port:     8123,
+			Database: "default",
+			User:     "default",
+		},
+	}
+	if profile == "production" {
+		/* nothing local is assumed, hosts must be configured */
+		s.InProduction = true
+		s.Postgres.Host = ""
+		s.Postgres.SSLMode = "require"
+		s.Clickhouse.Host = ""
+		s.Clickhouse.Secure = true
+	}
+	return s
+}
+
+/*
+LoadSettings reads the settings of a profile, development when profile is
+empty. The file is optional when path is empty, DefaultFile is used if it
+exists. Environment variables win over the file, see applyEnv.
+*/
+func LoadSettings(profile string, path string) (Settings, error) {
+	if profile == "" {
+		profile = "development"
+	}
+	if !isProfile(profile) {
+		return Settings{}, fmt.Errorf("unknown profile %q, use one of %s", profile, strings.Join(Profiles, ", "))
+	}
+
+	s := defaults(profile)
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			path = DefaultFile
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return s, err
+		}
+		/* a profile section only overrides the keys it has */
+		sections := map[string]yaml.Node{}
+		if err = yaml.Unmarshal(data, &sections); err != nil {
+			return s, fmt.Errorf("%s: %w", path, err)
+		}
+		for name := range sections {
+			if !isProfile(name) {
+				return s, fmt.Errorf("%s: unknown profile %q", path, name)
+			}
+		}
+		if section, found := sections[profile]; found {
+			if err = section.Decode(&s); err != nil {
+				return s, fmt.Errorf("%s: %s: %w", path, profile, err)
+			}
+		}
+	}
+
+	if err := s.applyEnv(); err != nil {
+		return s, err
+	}
+	return s, s.Validate()
+}
+
+func isProfile(name string) bool {
+	for _, p := range Profiles {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+/* applyEnv overrides settings with the SLAASH_* and SHOPIFY_* variables that are set */
+func (s *Settings) applyEnv() error {
+	strs := map[string]*string{
+		"SLAASH_PORT":                &s.Port,
+		"SLAASH_ANALYTICS_BACKEND":   &s.AnalyticsBackend,
+		"SLAASH_CLICKSTREAM_SPOOL":   &s.ClickstreamSpool,
+		"SLAASH_POSTGRES_HOST":       &s.Postgres.Host,
+		"SLAASH_POSTGRES_DATABASE":   &s.Postgres.Database,
+		"SLAASH_POSTGRES_USER":       &s.Postgres.User,
+		"SLAASH_POSTGRES_PASSWORD":   &s.Postgres.Password,
+		"SLAASH_POSTGRES_SSLMODE":    &s.Postgres.SSLMode,
+		"SLAASH_CLICKHOUSE_HOST":     &s.Clickhouse.Host,
+		"SLAASH_CLICKHOUSE_DATABASE": &s.Clickhouse.Database,
+		"SLAASH_CLICKHOUSE_USER":     &s.Clickhouse.User,
+		"SLAASH_CLICKHOUSE_PASSWORD": &s.Clickhouse.Password,
+		"SHOPIFY_API_KEY":            &s.Shopify.ApiKey,
+		"SHOPIFY_API_SECRET":         &s.Shopify.ApiSecret,
+		"SHOPIFY_REDIRECT_URL":       &s.Shopify.RedirectURL,
+		"SHOPIFY_WEBHOOK_URL":        &s.Shopify.WebhookURL,
+		"SHOPIFY_STOREFRONT_URL":     &s.Shopify.StorefrontURL,
+	}
+	for name, field := range strs {
+		if v, found := os.LookupEnv(name); found {
+			*field = v
+		}
+	}
+
+	ints := map[string]*int{
+		"SLAASH_POSTGRES_PORT":   &s.Postgres.Port,
+		"SLAASH_CLICKHOUSE_PORT": &s.Clickhouse.Port,
+	}
+	for name, field := range ints {
+		if v, found := os.LookupEnv(name); found {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			*field = n
+		}
+	}
+
+	if v, found := os.LookupEnv("SLAASH_CLICKHOUSE_SECURE"); found {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("SLAASH_CLICKHOUSE_SECURE must be true or false")
+		}
+		s.Clickhouse.Secure = b
+	}
+	if v, found := os.LookupEnv("SLAASH_TOKEN_KEYS"); found {
+		s.TokenKeys = strings.Split(v, ",")
+	}
+	if v, found := os.LookupEnv("SHOPIFY_SCOPES"); found {
+		s.Shopify.Scopes = nil
+		for _, scope := range strings.Split(v, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				s.Shopify.Scopes = append(s.Shopify.Scopes, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate reports every missing or malformed setting at once
+func (s Settings) Validate() error {
+	problems := []string{}
+	missing := func(name, v string) {
+		if strings.TrimSpace(v) == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+
+	if !strings.HasPrefix(s.Port, ":") {
+		problems = append(problems, "port must look like :8080")
+	} else if n, err := strconv.Atoi(s.Port[1:]); err != nil || n < 1 || n > 65535 {
+		problems = append(problems, "port must look like :8080")
+	}
+	if s.AnalyticsBackend != "postgres" && s.AnalyticsBackend != "clickhouse" {
+		problems = append(problems, "analytics_backend must be postgres or clickhouse")
+	}
+	missing("clickstream_spool", s.ClickstreamSpool)
+
+	missing("postgres.host", s.Postgres.Host)
+	missing("postgres.database", s.Postgres.Database)
+	missing("postgres.user", s.Postgres.User)
+	if s.Postgres.Port < 1 || s.Postgres.Port > 65535 {
+		problems = append(problems, "postgres.port is out of range")
+	}
+	missing("clickhouse.host", s.Clickhouse.Host)
+	missing("clickhouse.user", s.Clickhouse.User)
+	if s.Clickhouse.Port < 1 || s.Clickhouse.Port > 65535 {
+		problems = append(problems, "clickhouse.port is out of range")
+	}
+
+	missing("shopify.api_key", s.Shopify.ApiKey)
+	missing("shopify.api_secret", s.Shopify.ApiSecret)
+	if len(s.Shopify.Scopes) == 0 {
+		problems = append(problems, "shopify.scopes is required")
+	}
+	urls := [][2]string{
+		{"shopify.redirect_url", s.Shopify.RedirectURL},
+		{"shopify.webhook_url", s.Shopify.WebhookURL},
+		{"shopify.storefront_url", s.Shopify.StorefrontURL},
+	}
+	for _, pair := range urls {
+		name, v := pair[0], pair[1]
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			problems = append(problems, name+" must be an absolute URL")
+		} else if s.InProduction && u.Scheme != "https" {
+			problems = append(problems, name+" must be https in production")
+		}
+	}
+
+	if len(s.TokenKeys) == 0 {
+		problems = append(problems, "token_keys is required")
+	} else if _, err := secrets.NewKeyring(s.TokenKeys); err != nil {
+		problems = append(problems, "token_keys: "+err.Error())
+	}
+
+	if s.InProduction {
+		if s.Postgres.SSLMode == "disable" {
+			problems = append(problems, "postgres.sslmode can't be disable in production")
+		}
+		if !s.Clickhouse.Secure {
+			problems = append(problems, "clickhouse.secure must be true in production")
+		}
+		missing("postgres.password", s.Postgres.Password)
+		missing("clickhouse.password", s.Clickhouse.Password)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid %s settings: %s", s.Profile, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// PostgresDSN is the connection string for driver.ConnectSQL
+func (s Settings) PostgresDSN() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(s.Postgres.User, s.Postgres.Password),
+		Host:     fmt.Sprintf("%s:%d", s.Postgres.Host, s.Postgres.Port),
+		Path:     "/" + s.Postgres.Database,
+		RawQuery: url.Values{"sslmode": {s.Postgres.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+// ClickhouseDSN is the connection string for driver.ConnectClickhouse
+func (s Settings) ClickhouseDSN() string {
+	q := url.Values{"username": {s.Clickhouse.User}, "password": {s.Clickhouse.Password}}
+	scheme := "http"
+	if s.Clickhouse.Secure {
+		scheme = "https"
+		q.Set("secure", "true")
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     fmt.Sprintf("%s:%d", s.Clickhouse.Host, s.Clickhouse.Port),
+		Path:     "/" + s.Clickhouse.Database,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+/* Redacted is a copy safe to log, secrets that are set read [redacted] */
+func (s Settings) Redacted() Settings {
+	for _, secret := range []*string{&s.Postgres.Password, &s.Clickhouse.Password, &s.Shopify.ApiSecret} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	/* key ids tell which keys are loaded, the keys themselves never show */
+	keys := make([]string, len(s.TokenKeys))
+	for k, key := range s.TokenKeys {
+		id, _, _ := strings.Cut(strings.TrimSpace(key), ":")
+		keys[k] = id + ":" + redacted
+	}
+	s.TokenKeys = keys
+	return s
+}
+
+/* String is the redacted settings, so printing them never leaks a secret */
+func (s Settings) String() string {
+	r := s.Redacted()
+	return fmt.Sprintf("profile=%s port=%s in_production=%t postgres=%s@%s:%d/%s sslmode=%s password=%s "+
+		"clickhouse=%s@%s:%d/%s secure=%t password=%s shopify.api_key=%s shopify.api_secret=%s "+
+		"shopify.scopes=%s analytics_backend=%s clickstream_spool=%s token_keys=%s",
+		r.Profile, r.Port, r.InProduction,
+		r.Postgres.User, r.Postgres.Host, r.Postgres.Port, r.Postgres.Database, r.Postgres.SSLMode, r.Postgres.Password,
+		r.Clickhouse.User, r.Clickhouse.Host, r.Clickhouse.Port, r.Clickhouse.Database, r.Clickhouse.Secure, r.Clickhouse.Password,
+		r.Shopify.ApiKey, r.Shopify.ApiSecret, strings.Join(r.Shopify.Scopes, ","), r.AnalyticsBackend, r.ClickstreamSpool,
+		strings.Join(r.TokenKeys, ","))
+}
+
+/* GoString keeps %#v redacted too */
+func (s Settings) GoString() string {
+	return s.String()
+}
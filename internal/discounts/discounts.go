@@ -0,0 +1,309 @@
+package discounts
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	goshopify "github.com/bold-commerce/go-shopify/v3"
+	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/helpers"
+	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/repository"
+)
+
+const batchSize = 20             // codes generated per refill
+const lowWatermark = 5           // refill once fewer unissued codes remain
+const defaultTimer = 15          // minutes, used when the visitor has no timer
+const reapInterval = time.Minute // how often expired codes are revoked
+const reapBatch = 100            // expired codes revoked per tick
+
+// ErrNoDiscount is returned when no price rule applies to the product
+var ErrNoDiscount = errors.New("no discount configured for product")
+
+// ErrCodeShown is returned when the visitor's funnel got a code from a concurrent call
+var ErrCodeShown = errors.New("code already shown to visitor")
+
+/* poolKey identifies the pool of pre-generated codes under one price rule */
+type poolKey struct {
+	store     models.Store
+	priceRule int64
+}
+
+// Issuer hands out single use discount codes to visitors
+type Issuer struct {
+	App         *config.AppConfig
+	DB          repository.DatabaseRepo
+	refill      chan poolKey
+	collections sync.Map // "store:product" -> []int64 collection ids
+	limited     sync.Map // price rules known to carry the single use limit
+}
+
+// NewIssuer creates the code issuer, Run must be started for pools to refill
+func NewIssuer(a *config.AppConfig, db repository.DatabaseRepo) *Issuer {
+	return &Issuer{
+		App:    a,
+		DB:     db,
+		refill: make(chan poolKey, 64),
+	}
+}
+
+/*
+Issue claims a pre-generated code under the product's price rule for the visitor
+and records it on their funnel row. The code is revoked on shopify after the timer runs out.
+*/
+func (i *Issuer) Issue(store models.Store, v models.Visitor, timer int8) (models.DiscountCode, error) {
+	var code models.DiscountCode
+
+	prId, err := i.priceRuleFor(store, v.ProductId)
+	if err != nil {
+		return code, err
+	}
+
+	if timer <= 0 {
+		timer = defaultTimer
+	}
+	expires := time.Now().UTC().Add(time.Duration(timer) * time.Minute)
+
+	code, found, err := i.DB.ClaimDiscountCode(store.ID, prId, expires)
+	if err != nil {
+		return code, err
+	}
+	i.requestRefill(poolKey{store, prId})
+
+	if !found {
+		/* pool ran dry, generate this one on the spot */
+		i.App.InfoLog.Println("Code pool empty for price rule", prId)
+		err = i.fill(poolKey{store, prId}, 1)
+		if err != nil {
+			return code, err
+		}
+		code, found, err = i.DB.ClaimDiscountCode(store.ID, prId, expires)
+		if err != nil {
+			return code, err
+		}
+		if !found {
+			return code, fmt.Errorf("could not claim a code for price rule %d", prId)
+		}
+	}
+
+	attached, err := i.DB.AttachCodeToVisitor(v.ID, code.ShopifyID, timer)
+	if err != nil {
+		return code, err
+	}
+	if !attached {
+		/* the claimed code is left to expire and gets revoked by reap */
+		return code, ErrCodeShown
+	}
+	return code, nil
+}
+
+// Redeem records a used pooled code and removes it from shopify, the usage limit already stops a second use
+func (i *Issuer) Redeem(store models.Store, code models.DiscountCode) error {
+	if !code.Pooled {
+		return nil
+	}
+	err := store.DeleteDiscountByDiscId(code.ShopifyID, code.PriceRuleID)
+	if err != nil {
+		return err
+	}
+	return i.DB.RedeemDiscountCode(code.ShopifyID)
+}
+
+// Run refills pools on demand and revokes expired codes, it never returns
+func (i *Issuer) Run() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case key := <-i.refill:
+			n, err := i.DB.CountPooledCodes(key.store.ID, key.priceRule)
+			if err != nil {
+				i.App.ErrorLog.Println("Failed to count code pool:", err)
+				continue
+			}
+			if n < lowWatermark {
+				if err = i.fill(key, batchSize-n); err != nil {
+					i.App.ErrorLog.Println("Failed to refill code pool:", err)
+				}
+			}
+		case <-ticker.C:
+			i.reap()
+			i.retire()
+		}
+	}
+}
+
+/* requestRefill queues a pool check without ever blocking the caller */
+func (i *Issuer) requestRefill(key poolKey) {
+	select {
+	case i.refill <- key:
+	default:
+	}
+}
+
+/*
+fill creates n new codes on shopify and adds them to the pool. Price rules
+created before the single use limit get it before their first refill.
+*/
+func (i *Issuer) fill(key poolKey, n int) error {
+	if _, ok := i.limited.Load(key.priceRule); !ok {
+		if err := key.store.LimitPriceRule(key.priceRule); err != nil {
+			return err
+		}
+		i.limited.Store(key.priceRule, true)
+	}
+
+	codes := []models.DiscountCode{}
+	var err error
+	for j := 0; j < n; j++ {
+		code, e := helpers.NewDiscountCode()
+		if e != nil {
+			err = e
+			break
+		}
+		id, e := key.store.CreateDiscountByPrID(key.priceRule, goshopify.PriceRuleDiscountCode{Code: code})
+		if e != nil {
+			err = e
+			break
+		}
+		codes = append(codes, models.DiscountCode{
+			ShopifyID:   id,
+			Store:       key.store.ID,
+			PriceRuleID: key.priceRule,
+			Code:        code,
+			Timestamp:   time.Now(),
+			Pooled:      true,
+		})
+	}
+
+	/* keep whatever was created on shopify even if the batch stopped early */
+	if len(codes) > 0 {
+		if dbErr := i.DB.InsertDiscountCodes(codes); dbErr != nil {
+			return dbErr
+		}
+	}
+	return err
+}
+
+/* reap revokes issued codes whose timer has run out and retired shared codes */
+func (i *Issuer) reap() {
+	codes, err := i.DB.GetExpiredDiscountCodes(reapBatch)
+	if err != nil {
+		i.App.ErrorLog.Println("Failed to fetch expired codes:", err)
+		return
+	}
+
+	stores := make(map[int]models.Store)
+	for _, c := range codes {
+		store, found := stores[c.Store]
+		if !found {
+			store, err = i.DB.GetStoreByID(c.Store)
+			if err != nil {
+				i.App.ErrorLog.Println("Failed to fetch store", c.Store, err)
+				continue
+			}
+			stores[c.Store] = store
+		}
+		err = store.DeleteDiscountByDiscId(c.ShopifyID, c.PriceRuleID)
+		if err != nil {
+			i.App.ErrorLog.Println("Failed to revoke code", c.Code, err)
+			continue
+		}
+		if err = i.DB.RevokeDiscountCode(c.ShopifyID); err != nil {
+			i.App.ErrorLog.Println(err)
+		}
+	}
+}
+
+/* retire deletes the price rules of removed discounts that shopify failed to delete before */
+func (i *Issuer) retire() {
+	rules, err := i.DB.GetRetiredPriceRules(reapBatch)
+	if err != nil {
+		i.App.ErrorLog.Println("Failed to fetch retired price rules:", err)
+		return
+	}
+
+	stores := make(map[int]models.Store)
+	for _, r := range rules {
+		store, found := stores[r.Store]
+		if !found {
+			store, err = i.DB.GetStoreByID(r.Store)
+			if err != nil {
+				i.App.ErrorLog.Println("Failed to fetch store", r.Store, err)
+				continue
+			}
+			stores[r.Store] = store
+		}
+		if err = store.DeletePriceRule(r.PriceRuleID); err != nil {
+			i.App.ErrorLog.Println("Failed to delete price rule", r.PriceRuleID, err)
+			continue
+		}
+		if err = i.DB.DropRetiredPriceRule(r.Store, r.PriceRuleID); err != nil {
+			i.App.ErrorLog.Println(err)
+		}
+	}
+}
+
+/* priceRuleFor finds the price rule of the discount that applies to the product */
+func (i *Issuer) priceRuleFor(store models.Store, productID int64) (int64, error) {
+	switch store.DiscountCateogry {
+	case 1:
+		prId, found, err := i.DB.GetPriceRuleForProduct(store.ID, 1, 0)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return prId, nil
+		}
+	case 2:
+		prId, found, err := i.DB.GetPriceRuleForProduct(store.ID, 2, productID)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			return prId, nil
+		}
+	case 3:
+		ids, err := i.collectionsOf(store, productID)
+		if err != nil {
+			return 0, err
+		}
+		for _, cid := range ids {
+			prId, found, err := i.DB.GetPriceRuleForProduct(store.ID, 3, cid)
+			if err != nil {
+				return 0, err
+			}
+			if found {
+				return prId, nil
+			}
+		}
+	}
+	return 0, ErrNoDiscount
+}
+
+// ForgetProduct drops the cached collections of a product, they are fetched again on its next code
+func (i *Issuer) ForgetProduct(store models.Store, productID int64) {
+	i.collections.Delete(collectionsKey(store, productID))
+}
+
+/* collectionsKey is the key of a product in the collections cache */
+func collectionsKey(store models.Store, productID int64) string {
+	return fmt.Sprintf("%d:%d", store.ID, productID)
+}
+
+/* collectionsOf caches product collections so shopify is asked once per product */
+func (i *Issuer) collectionsOf(store models.Store, productID int64) ([]int64, error) {
+	key := collectionsKey(store, productID)
+	if ids, ok := i.collections.Load(key); ok {
+		return ids.([]int64), nil
+	}
+	ids, err := store.GetCollectionIDsByProduct(productID)
+	if err != nil {
+		return nil, err
+	}
+	i.collections.Store(key, ids)
+	return ids, nil
+}
@@ -16,13 +16,6 @@ type DB struct {
 	SQL *sql.DB
 }
 
-type DBCreds struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-}
-
 var dbConn = &DB{}
 var clickhouseConn = &DB{}
 
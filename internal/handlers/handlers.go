@@ -1,38 +1,63 @@
 package handlers
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/malalwan/slaash/internal/analytics"
+	"github.com/malalwan/slaash/internal/collect"
 	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/discounts"
 	"github.com/malalwan/slaash/internal/driver"
 	"github.com/malalwan/slaash/internal/helpers"
 	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/otf"
 	"github.com/malalwan/slaash/internal/repository"
 	"github.com/malalwan/slaash/internal/repository/dbrepo"
+	"github.com/malalwan/slaash/internal/theme"
 	"golang.org/x/oauth2"
 )
 
 // Repo the repository used by the handlers
 var Repo *Repository
 
+/* OTF verdicts younger than this are served without asking clickhouse */
+const otfCacheTTL = 30 * time.Second
+
+/* a shopify login this recent stands in for the current password on a password change */
+const shopifyLoginWindow = 10 * time.Minute
+
 // Repository is the repository type
 type Repository struct {
 	App        *config.AppConfig
 	DB         repository.DatabaseRepo
 	Clickhouse repository.ClickhouseRepo
+	Analytics  repository.AnalyticsRepo
+	Codes      *discounts.Issuer
+	Themes     *theme.Deployer
+	Collector  *collect.Collector
 }
 
 // NewRepo creates a new repository
 func NewRepo(a *config.AppConfig, db *driver.DB, clickhouse *driver.DB) *Repository {
+	dbRepo := dbrepo.NewPostgresRepo(db.SQL, a)
+	chRepo := dbrepo.NewClickhouseRepo(clickhouse.SQL, a)
 	return &Repository{
 		App:        a,
-		DB:         dbrepo.NewPostgresRepo(db.SQL, a),
-		Clickhouse: dbrepo.NewClickhouseRepo(clickhouse.SQL, a),
+		DB:         dbRepo,
+		Clickhouse: chRepo,
+		Analytics:  dbrepo.NewAnalyticsRepo(db.SQL, clickhouse.SQL, a),
+		Codes:      discounts.NewIssuer(a, dbRepo),
+		Themes:     theme.NewDeployer(a, dbRepo),
+		Collector:  collect.NewCollector(a, chRepo, a.ClickstreamSpool),
 	}
 }
 
@@ -54,7 +79,6 @@ func (m *Repository) TestSession(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("user.FirstName: %v\n", user.FirstName)
 	fmt.Printf("user.LastName: %v\n", user.LastName)
-	fmt.Printf("store.ApiToken: %v\n", store.ApiToken)
 	fmt.Printf("store.Name: %v\n", store.Name)
 }
 
@@ -107,36 +131,138 @@ func (m *Repository) Login(w http.ResponseWriter, r *http.Request) {
 	}
 	m.App.Session.RenewToken(r.Context())
 	m.App.Session.Put(r.Context(), "user", user)
+	m.App.Session.Remove(r.Context(), "shopify_login_at")
 	m.App.InfoLog.Println("User Logged in and session set")
 }
 
+/*
+ShopifyLogin handles the shopify app install
+Prerequisites: None
+Input: shop, hmac (login, callback), state and code (callback)
+Output:
+(1) login : Redirect to the shopify authorize page with a state nonce
+(2) callback : Verify the request, save the access token against Store,
+link or create the owner User and redirect to the app in the shopify admin
+*/
 func (m *Repository) ShopifyLogin(w http.ResponseWriter, r *http.Request) {
-	// Display a link to start the login process
 	la := chi.URLParam(r, "loginAction")
-	host := r.Host
+	if la != "login" && la != "callback" {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	shop := q.Get("shop")
+	if !helpers.IsValidShop(shop) {
+		m.App.ErrorLog.Println("Invalid shop hostname:", shop)
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	/* shopify signs the install request and always signs the callback */
+	if q.Get("hmac") != "" || la == "callback" {
+		ok, err := models.ShopifyApp().VerifyAuthorizationURL(r.URL)
+		if err != nil || !ok {
+			m.App.ErrorLog.Println("HMAC verification failed for", shop)
+			helpers.ClientError(w, http.StatusUnauthorized)
+			return
+		}
+	}
+
 	oauthConf := &oauth2.Config{
 		ClientID:     m.App.MyAppCreds[0],
 		ClientSecret: m.App.MyAppCreds[1],
 		RedirectURL:  m.App.RedirectURL,
 		Scopes:       m.App.MyScopes,
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  fmt.Sprintf("https://%s/admin/oauth/authorize", host),
-			TokenURL: fmt.Sprintf("https://%s/admin/oauth/access_token", host),
+			AuthURL:  fmt.Sprintf("https://%s/admin/oauth/authorize", shop),
+			TokenURL: fmt.Sprintf("https://%s/admin/oauth/access_token", shop),
 		},
 	}
 	switch la {
 	case "login":
-		http.Redirect(w, r, oauthConf.AuthCodeURL("", oauth2.AccessTypeOffline), http.StatusFound)
+		state, err := helpers.NewNonce()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "oauth_state", state)
+		m.App.Session.Put(r.Context(), "oauth_shop", shop)
+		http.Redirect(w, r, oauthConf.AuthCodeURL(state, oauth2.AccessTypeOffline), http.StatusFound)
 	case "callback":
+		state := m.App.Session.PopString(r.Context(), "oauth_state")
+		installShop := m.App.Session.PopString(r.Context(), "oauth_shop")
+		if state == "" || installShop != shop ||
+			subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 {
+			m.App.ErrorLog.Println("OAuth state mismatch for", shop)
+			helpers.ClientError(w, http.StatusForbidden)
+			return
+		}
+
 		// Exchange authorization code for access token
-		code := r.URL.Query().Get("code")
-		token, err := oauthConf.Exchange(r.Context(), code)
+		token, err := oauthConf.Exchange(r.Context(), q.Get("code"))
 		if err != nil {
 			http.Error(w, "Error exchanging code for token", http.StatusInternalServerError)
 			return
 		}
-		// Display the access token
-		fmt.Fprintf(w, "Access Token: %s", token.AccessToken)
+
+		/* the token is sealed right away, only InitClient ever opens it */
+		store := models.Store{Name: shop}
+		err = store.SetApiToken(token.AccessToken)
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to seal the access token for", shop)
+			helpers.ServerError(w, err)
+			return
+		}
+		store.PublicKey, err = helpers.NewNonce()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		info, err := store.GetShopInfo()
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to fetch shop info from shopify")
+			helpers.ServerError(w, err)
+			return
+		}
+		store.URL = info.Domain
+		store.Currency = info.Currency
+		store.Timezone = info.IanaTimezone
+
+		/* the owner logs in through shopify until a password is set */
+		pass, err := helpers.NewNonce()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		first, last, _ := strings.Cut(info.ShopOwner, " ")
+		owner := models.Users{
+			FirstName:   first,
+			LastName:    last,
+			Email:       info.Email,
+			Password:    pass,
+			AccessLevel: 1,
+		}
+		storeid, user, err := m.DB.InstallStore(store, owner)
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to save store")
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.InfoLog.Println("Installed store", shop, "for", user.Email)
+
+		/* a failed subscription is retried on the next install, don't block it */
+		err = store.RegisterWebhooks()
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to register webhooks for", shop, err)
+		}
+
+		/* the session is for the store just installed, whichever store the user signed up with */
+		user.Store = storeid
+		m.App.Session.RenewToken(r.Context())
+		m.App.Session.Put(r.Context(), "user", user)
+		m.App.Session.Put(r.Context(), "shopify_login_at", time.Now())
+		http.Redirect(w, r, fmt.Sprintf("https://%s/admin/apps/%s", shop, m.App.MyAppCreds[0]), http.StatusSeeOther)
 	}
 }
 
@@ -185,58 +311,52 @@ func (m *Repository) TurnOffNextCampaign(w http.ResponseWriter, r *http.Request)
 func (m *Repository) GetCampaignActivity(w http.ResponseWriter, r *http.Request) {
 	user := m.App.Session.Get(r.Context(), "user").(models.Users)
 	storeid := user.Store
-	endTime, err := m.DB.GetCampignEndTime(storeid) // call to store
+	store, err := m.DB.GetStoreByID(storeid)
 	if err != nil {
-		m.App.ErrorLog.Println("Failed to fetch Campaign timers")
+		m.App.ErrorLog.Println("Failed to fetch Store info from ID")
 		helpers.ServerError(w, err)
+		return
 	}
-	money, err := m.DB.GetAggFromCheckout(storeid) // call to checkout
-	if err != nil {
-		m.App.ErrorLog.Println("Failed to fetch GMV and Discount data")
-		helpers.ServerError(w, err)
+
+	/* the running campaign so far against the same stretch of the one before */
+	now := time.Now()
+	start := store.CampaignStart(now)
+	endTime := start.AddDate(0, 0, 1)
+	q := models.AnalyticsQuery{
+		From:        start,
+		To:          now,
+		CompareFrom: start.AddDate(0, 0, -1),
+		CompareTo:   start.AddDate(0, 0, -1).Add(now.Sub(start)),
+		Location:    store.Location(),
 	}
-	stats, err := m.DB.GetAggFromVisitor(storeid) // call to visitor
+	stats, err := analytics.Compare(q, storeid, m.Analytics.GetCheckoutTotals, m.Analytics.GetVisitorTotals)
 	if err != nil {
-		m.App.ErrorLog.Println("Failed to fetch visitor data")
+		m.App.ErrorLog.Println("Failed to fetch campaign stats")
 		helpers.ServerError(w, err)
+		return
 	}
+
 	data := models.CampaignActivity{}
-	store, err := m.DB.GetStoreByID(storeid)
-	if err != nil {
-		m.App.ErrorLog.Println("Failed to fetch Store info from ID")
-		helpers.ServerError(w, err)
-	}
 	data.CampaignEndTime.Value = endTime.String()
-	data.CampaignEndTime.Nextin = int(endTime.Sub(time.Now()).Hours())
-	data.Discount.Value = money["discount"][0]
+	data.CampaignEndTime.Nextin = int(endTime.Sub(now).Hours())
+	data.Discount.Value = helpers.Units(stats["discount"].Current)
 	data.GmvActiveSession.CurrencyType = store.Currency
-	data.GmvActiveSession.Value = money["gmv"][0]
-	data.GmvActiveSession.GmvVertical.Positive = money["gmv"][0] >= money["gmv"][1]
-	if money["gmv"][1] == 0 {
-		data.GmvActiveSession.GmvVertical.ChangePercentage = 0
-	} else {
-		data.GmvActiveSession.GmvVertical.ChangePercentage = (float32(money["gmv"][0]-money["gmv"][1]) / float32(money["gmv"][1])) * 100
-	}
-	data.ProductsActiveSession.Products = stats["products"][0]
-	data.ProductsActiveSession.ProductsVertical.Positive = stats["products"][0] >= stats["products"][1]
-	if stats["products"][1] == 0 {
-		data.ProductsActiveSession.ProductsVertical.ChangePercentage = 0
-	} else {
-		data.ProductsActiveSession.ProductsVertical.ChangePercentage = (float32(stats["products"][0]-stats["products"][1]) / float32(stats["products"][1])) * 100
-	}
-	data.ActiveUsers.ActiveUsersInSession = stats["users"][0]
-	data.ActiveUsers.ActiveUsersVertical.Positive = stats["users"][0] >= stats["users"][1]
-	if stats["users"][1] == 0 {
-		data.ActiveUsers.ActiveUsersVertical.ChangePercentage = 0
-	} else {
-		data.ActiveUsers.ActiveUsersVertical.ChangePercentage = (float32(stats["users"][0]-stats["users"][1]) / float32(stats["users"][1])) * 100
-	}
-
-	m.App.InfoLog.Println(data)
+	data.GmvActiveSession.Value = helpers.Units(stats["gmv"].Current)
+	data.GmvActiveSession.GmvVertical.Positive = stats["gmv"].Up
+	data.GmvActiveSession.GmvVertical.ChangePercentage = stats["gmv"].Change
+	data.ProductsActiveSession.Products = stats["products"].Current
+	data.ProductsActiveSession.ProductsVertical.Positive = stats["products"].Up
+	data.ProductsActiveSession.ProductsVertical.ChangePercentage = stats["products"].Change
+	data.ActiveUsers.ActiveUsersInSession = stats["users"].Current
+	data.ActiveUsers.ActiveUsersVertical.Positive = stats["users"].Up
+	data.ActiveUsers.ActiveUsersVertical.ChangePercentage = stats["users"].Change
+
 	// Marshal the map into a JSON string
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
 	}
 
 	fmt.Fprintf(w, "%s\n", jsonData)
@@ -246,93 +366,47 @@ func (m *Repository) GetDealListActivity(w http.ResponseWriter, r *http.Request)
 	user := m.App.Session.Get(r.Context(), "user").(models.Users)
 	storeid := user.Store
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+	q, ok := m.analyticsQuery(w, r, storeid)
+	if !ok {
 		return
 	}
 
-	var requestBody struct {
-		DuratonType string `json:"durationType"`
-	}
-	if err := json.Unmarshal(body, &requestBody); err != nil {
-		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
-		m.App.ErrorLog.Println(err)
-		return
-	}
-
-	duration := requestBody.DuratonType
-	startTime := time.Now()
-	endTime := time.Now()
-	switch duration {
-	case "12hours":
-		startTime = startTime.Add(-12 * time.Hour)
-		endTime = startTime.Add(-24 * time.Hour)
-	case "24hours":
-		startTime = startTime.Add(-24 * time.Hour)
-		endTime = startTime.Add(-48 * time.Hour)
-	case "weekly":
-		startTime = startTime.Add(-24 * 7 * time.Hour)
-		endTime = startTime.Add(-48 * 7 * time.Hour)
-	case "monthly":
-		startTime = startTime.Add(-24 * 30 * time.Hour)
-		endTime = startTime.Add(-48 * 30 * time.Hour)
-	}
-
-	money, err := m.DB.GetDealDataFromCheckout(startTime, endTime, storeid)
+	totals, err := analytics.Compare(q, storeid, m.Analytics.GetCheckoutTotals, m.Analytics.GetVisitorTotals)
 	if err != nil {
-		m.App.ErrorLog.Println("Failed to fetch deal data from checkout")
-		helpers.ServerError(w, err)
-	}
-	data, err := m.DB.GetDealDataFromVisitor(startTime, endTime, storeid)
-	if err != nil {
-		m.App.ErrorLog.Println("Failed to fetch deal data from visitor")
+		m.App.ErrorLog.Println("Failed to fetch deal list totals")
 		helpers.ServerError(w, err)
+		return
 	}
 
-	moneySeries, err := m.DB.GetSeriesDataFromCheckout(startTime, storeid)
+	moneySeries, err := m.Analytics.GetSeriesDataFromCheckout(q, storeid)
 	if err != nil {
 		m.App.ErrorLog.Println("Failed to fetch series data from checkout")
 		helpers.ServerError(w, err)
+		return
 	}
-	dataSeries, err := m.DB.GetSeriesDataFromVisitor(startTime, storeid)
+	dataSeries, err := m.Analytics.GetSeriesDataFromVisitor(q, storeid)
 	if err != nil {
 		m.App.ErrorLog.Println("Failed to fetch series data from visitor")
 		helpers.ServerError(w, err)
+		return
 	}
 
 	stats := models.DealListActivity{}
 
-	stats.DiscountSpends.Price = money["discount"][0]
-	stats.DiscountSpends.DiscountSpendsVertical.DiscountSpendsVertical = money["discount"][0] > money["discount"][1]
-	if money["discount"][1] == 0 {
-		stats.DiscountSpends.DiscountSpendsVertical.VerticalVal = 0
-	} else {
-		stats.DiscountSpends.DiscountSpendsVertical.VerticalVal = (float32(money["discount"][0]-money["discount"][1]) / float32(money["discount"][1])) * 100
-	}
-	stats.Gmv.Price = money["gmv"][0]
-	stats.Gmv.GmvVertical.GmvVertical = money["gmv"][0] >= money["gmv"][1]
-	if money["gmv"][1] == 0 {
-		stats.Gmv.GmvVertical.VerticalVal = 0
-	} else {
-		stats.Gmv.GmvVertical.VerticalVal = (float32(money["gmv"][0]-money["gmv"][1]) / float32(money["gmv"][1])) * 100
-	}
-	stats.Products.Price = data["products"][0]
-	stats.Products.ProductsVertical.ProductsVertical = data["products"][0] >= data["products"][1]
-	if data["products"][1] == 0 {
-		stats.Products.ProductsVertical.VerticalVal = 0
-	} else {
-		stats.Products.ProductsVertical.VerticalVal = (float32(data["products"][0]-data["products"][1]) / float32(data["products"][1])) * 100
-	}
-	stats.Users.Price = data["users"][0]
-	stats.Users.UsersVertical.UsersVertical = data["users"][0] >= data["users"][1]
-	if data["users"][1] == 0 {
-		stats.Users.UsersVertical.VerticalVal = 0
-	} else {
-		stats.Users.UsersVertical.VerticalVal = (float32(data["users"][0]-data["users"][1]) / float32(data["users"][1])) * 100
-	}
-	stats.GmvData = moneySeries[0]
-	stats.DiscountsData = moneySeries[1]
+	stats.DiscountSpends.Price = helpers.Units(totals["discount"].Current)
+	stats.DiscountSpends.DiscountSpendsVertical.DiscountSpendsVertical = totals["discount"].Up
+	stats.DiscountSpends.DiscountSpendsVertical.VerticalVal = totals["discount"].Change
+	stats.Gmv.Price = helpers.Units(totals["gmv"].Current)
+	stats.Gmv.GmvVertical.GmvVertical = totals["gmv"].Up
+	stats.Gmv.GmvVertical.VerticalVal = totals["gmv"].Change
+	stats.Products.Price = totals["products"].Current
+	stats.Products.ProductsVertical.ProductsVertical = totals["products"].Up
+	stats.Products.ProductsVertical.VerticalVal = totals["products"].Change
+	stats.Users.Price = totals["users"].Current
+	stats.Users.UsersVertical.UsersVertical = totals["users"].Up
+	stats.Users.UsersVertical.VerticalVal = totals["users"].Change
+	stats.GmvData = helpers.UnitSeries(moneySeries[0])
+	stats.DiscountsData = helpers.UnitSeries(moneySeries[1])
 	stats.ProductsData = dataSeries[1]
 	stats.UsersData = dataSeries[0]
 
@@ -344,13 +418,39 @@ func (m *Repository) GetDealListActivity(w http.ResponseWriter, r *http.Request)
 	fmt.Fprintf(w, "%s\n", jsonData)
 }
 
+/*
+analyticsQuery reads the chart window of a dashboard request in the store's
+timezone. On a bad request it has already answered and returns false.
+*/
+func (m *Repository) analyticsQuery(w http.ResponseWriter, r *http.Request, storeid int) (models.AnalyticsQuery, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return models.AnalyticsQuery{}, false
+	}
+
+	store, err := m.DB.GetStoreByID(storeid)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch store")
+		helpers.ServerError(w, err)
+		return models.AnalyticsQuery{}, false
+	}
+
+	q, err := helpers.ParseAnalyticsQuery(body, store.Location(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return q, false
+	}
+	return q, true
+}
+
 func (m *Repository) GetTrendingProducts(w http.ResponseWriter, r *http.Request) {
 	/* Initialize the function with the user and store context from the session */
 	user := m.App.Session.Get(r.Context(), "user").(models.Users)
 	storeid := user.Store
 
 	/* DB API to fetch the most added products by end customers */
-	list, deals, discounts, gmv, err := m.DB.GetTopProducts(storeid)
+	list, deals, discounts, gmv, err := m.Analytics.GetTopProducts(storeid)
 	if err != nil {
 		m.App.ErrorLog.Println(err)
 	}
@@ -375,11 +475,11 @@ func (m *Repository) GetTrendingProducts(w http.ResponseWriter, r *http.Request)
 			ProductImage string
 			Users        int
 			Discount     struct {
-				Value        int
+				Value        float64
 				CurrencyType string
 			}
 			Gmv struct {
-				Value        int
+				Value        float64
 				CurrencyType string
 			}
 		}
@@ -387,9 +487,9 @@ func (m *Repository) GetTrendingProducts(w http.ResponseWriter, r *http.Request)
 		prod.ProductImage = p.Image.Src
 		prod.Users = deals[i]
 		prod.Discount.CurrencyType = store.Currency
-		prod.Discount.Value = discounts[i]
+		prod.Discount.Value = helpers.Units(discounts[i])
 		prod.Gmv.CurrencyType = store.Currency
-		prod.Gmv.Value = gmv[i]
+		prod.Gmv.Value = helpers.Units(gmv[i])
 
 		data.Products = append(data.Products, prod)
 	}
@@ -407,34 +507,12 @@ func (m *Repository) GetOtfVisitorData(w http.ResponseWriter, r *http.Request) {
 	user := m.App.Session.Get(r.Context(), "user").(models.Users)
 	storeid := user.Store
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-
-	var requestBody struct {
-		DurationType string `json:"durationType"`
-	}
-
-	if err := json.Unmarshal(body, &requestBody); err != nil {
-		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
-		m.App.ErrorLog.Println(err)
+	q, ok := m.analyticsQuery(w, r, storeid)
+	if !ok {
 		return
 	}
-	startTime := time.Now()
-	switch requestBody.DurationType {
-	case "12hours":
-		startTime = startTime.Add(-12 * time.Hour)
-	case "24hours":
-		startTime = startTime.Add(-24 * time.Hour)
-	case "weekly":
-		startTime = startTime.Add(-24 * 7 * time.Hour)
-	case "monthly":
-		startTime = startTime.Add(-24 * 30 * time.Hour)
-	}
 
-	data, err := m.DB.GetAggOtfByDuration(startTime, storeid)
+	data, err := m.Analytics.GetAggOtfByDuration(q, storeid)
 	if err != nil {
 		m.App.ErrorLog.Println(err)
 	}
@@ -455,16 +533,25 @@ func (m *Repository) GetAllCampaigns(w http.ResponseWriter, r *http.Request) {
 	user := m.App.Session.Get(r.Context(), "user").(models.Users)
 	storeid := user.Store
 
-	campaigns, err := m.DB.GetAllCampaigns(storeid)
+	campaigns, err := m.Analytics.GetAllCampaigns(storeid)
 	if err != nil {
 		m.App.ErrorLog.Println("Unable to fetch all campaigns")
 		helpers.ServerError(w, err)
+		return
+	}
+
+	/* the campaign amounts are read in cents */
+	for i := range campaigns {
+		campaigns[i].DiscountValue /= 100
+		campaigns[i].GmvValue /= 100
+		campaigns[i].Aov /= 100
 	}
 
 	jsonData, err := json.Marshal(campaigns)
 	if err != nil {
 		m.App.ErrorLog.Println(err)
 		helpers.ServerError(w, err)
+		return
 	}
 
 	fmt.Fprintf(w, "%s\n", jsonData)
@@ -556,6 +643,12 @@ func (m *Repository) ConfigureDiscountDefaults(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	/* the default discount is the store wide one of category 1 */
+	if requestBody.DiscountCateogry == 1 && !helpers.IsValidDiscount(requestBody.DefaultDiscount) {
+		http.Error(w, "Discounts must be between 1 and 100 percent", http.StatusBadRequest)
+		return
+	}
+
 	err = m.DB.UpdateDiscountDefaults(storeid, requestBody.DefaultDiscount, requestBody.DiscountCateogry)
 	if err != nil {
 		m.App.ErrorLog.Println(err)
@@ -566,6 +659,12 @@ func (m *Repository) ConfigureDiscountDefaults(w http.ResponseWriter, r *http.Re
 	store, err := m.DB.GetStoreByID(storeid)
 	switch requestBody.DiscountCateogry {
 	case 1:
+		err = m.DB.UpdateDiscounts(storeid, 1, nil)
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to update the store wide discount")
+			helpers.ServerError(w, err)
+			return
+		}
 		fmt.Fprintf(w, "Success\n")
 	case 2:
 		products, err := store.GetAllProducts()
@@ -619,6 +718,13 @@ func (m *Repository) ConfigureDiscounts(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	for _, perc := range requestBody.DisccoutMap {
+		if !helpers.IsValidDiscount(perc) {
+			http.Error(w, "Discounts must be between 1 and 100 percent", http.StatusBadRequest)
+			return
+		}
+	}
+
 	err = m.DB.UpdateDiscounts(storeid, requestBody.DiscountCateogry, requestBody.DisccoutMap)
 	if err != nil {
 		m.App.ErrorLog.Println("Failed to update discount values")
@@ -654,8 +760,103 @@ func (m *Repository) ConfigureDealList(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		m.App.ErrorLog.Println("Deal list config update failed!")
 		helpers.ServerError(w, err)
+		return
+	}
+
+	/* the widget script carries the config, so every change is redeployed */
+	store, err := m.DB.GetStoreByID(storeid)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch store")
+		helpers.ServerError(w, err)
+		return
+	}
+	dlInfo, err := m.DB.GetDealListInfo(storeid)
+	if err != nil {
+		m.App.ErrorLog.Println("Unable to fetch deal list info")
+		helpers.ServerError(w, err)
+		return
+	}
+	_, err = m.Themes.Deploy(store, dlInfo, user.Email)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to deploy deal list script for", store.Name, err)
+		helpers.ServerError(w, err)
+	}
+}
+
+/* GetThemeDeployments lists the store's latest pushes of slaash theme assets */
+func (m *Repository) GetThemeDeployments(w http.ResponseWriter, r *http.Request) {
+	user := m.App.Session.Get(r.Context(), "user").(models.Users)
+	storeid := user.Store
+
+	deployments, err := m.DB.GetThemeDeployments(storeid, 50)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch theme deployments")
+		helpers.ServerError(w, err)
+		return
+	}
+
+	jsonData, err := json.Marshal(deployments)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+/* RollbackThemeDeployment restores an asset to what it was before the given deployment */
+func (m *Repository) RollbackThemeDeployment(w http.ResponseWriter, r *http.Request) {
+	user := m.App.Session.Get(r.Context(), "user").(models.Users)
+	storeid := user.Store
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		DeploymentID int64 `json:"deployment_id"`
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	store, err := m.DB.GetStoreByID(storeid)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch store")
+		helpers.ServerError(w, err)
+		return
 	}
 
+	id, err := m.Themes.Rollback(store, requestBody.DeploymentID, user.Email)
+	if errors.Is(err, theme.ErrNoDeployment) {
+		helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Theme rollback failed for", store.Name, err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var response struct {
+		DeploymentID int64 // 0 when the asset already had that content
+	}
+	response.DeploymentID = id
+
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
 }
 
 func (m *Repository) UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
@@ -689,10 +890,89 @@ func (m *Repository) UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
 
 // from here
 
+/*
+UpdatePassword changes the dashboard password of the logged in user
+Prerequisites: User must be logged in
+Input: current_password, new_password. current_password can be left out within
+10 minutes of a shopify login, owners created by the install never saw theirs.
+Output: 204 once changed. The session gets a new token and every other
+session of the user is logged out.
+*/
 func (m *Repository) UpdatePassword(w http.ResponseWriter, r *http.Request) {
 	user := m.App.Session.Get(r.Context(), "user").(models.Users)
-	storeid := user.Store
-	fmt.Println(storeid)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+
+	loginAt := m.App.Session.GetTime(r.Context(), "shopify_login_at")
+	viaShopify := !loginAt.IsZero() && time.Since(loginAt) < shopifyLoginWindow
+	if requestBody.CurrentPassword == "" && !viaShopify {
+		http.Error(w, "Current password is required, or log in through shopify again", http.StatusForbidden)
+		return
+	}
+	if requestBody.CurrentPassword != "" {
+		_, found, err := m.DB.FetchUserByCreds(user.Email, requestBody.CurrentPassword)
+		if err != nil {
+			m.App.ErrorLog.Println("User Fatch Failed!")
+			helpers.ServerError(w, err)
+			return
+		}
+		if !found {
+			helpers.ClientError(w, http.StatusForbidden)
+			return
+		}
+	}
+	if requestBody.NewPassword == requestBody.CurrentPassword {
+		http.Error(w, "New password must differ from the current one", http.StatusBadRequest)
+		return
+	}
+	if err = helpers.CheckPasswordStrength(requestBody.NewPassword, user.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.UpdatePassword(user.Email, requestBody.NewPassword)
+	if err != nil {
+		m.App.ErrorLog.Println("Password update failed!")
+		helpers.ServerError(w, err)
+		return
+	}
+
+	/* the old token leaves the store here, so the sweep below can't log this session out */
+	err = m.App.Session.RenewToken(r.Context())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "shopify_login_at")
+	err = m.App.Session.Iterate(r.Context(), func(ctx context.Context) error {
+		other, ok := m.App.Session.Get(ctx, "user").(models.Users)
+		if !ok || other.Email != user.Email {
+			return nil
+		}
+		return m.App.Session.Destroy(ctx)
+	})
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to log out the other sessions of", user.Email)
+		helpers.ServerError(w, err)
+		return
+	}
+	m.App.InfoLog.Println("Password changed for", user.Email)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (m *Repository) GetPageLoadInfo(w http.ResponseWriter, r *http.Request) {
@@ -700,37 +980,170 @@ func (m *Repository) GetPageLoadInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Repository) GetOtfUserInfo(w http.ResponseWriter, r *http.Request) {
-	// we just pull the anonymousID and then pull the aggregate from click fucking house
+	user := m.App.Session.Get(r.Context(), "user").(models.Users)
+	storeid := user.Store
+
+	// we just pull the anonymousID and then pull the aggregate from clickhouse
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		m.App.ErrorLog.Panicln("Failed to read request body:", err)
-		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
 	var requestBody struct {
 		AnonymousID string `json:"anonymousid"`
 	}
-	err = json.Unmarshal(body, &requestBody)
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	res, err := m.otfVerdict(storeid, requestBody.AnonymousID)
 	if err != nil {
-		m.App.ErrorLog.Panicln("Failed to Parse JSON")
+		m.App.ErrorLog.Println("OTF scoring failed")
+		helpers.ServerError(w, err)
+		return
 	}
-	vt, err := m.Clickhouse.PullStreamByAnonymousID(requestBody.AnonymousID)
+
+	jsonData, err := json.Marshal(res)
 	if err != nil {
+		m.App.ErrorLog.Println(err)
 		helpers.ServerError(w, err)
-		m.App.ErrorLog.Panicln("Clickhouse pe data naas", err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+/*
+otfVerdict returns the cached verdict of a visitor while it is fresh.
+After otfCacheTTL clickhouse is asked for the newest event only, the
+clickstream is pulled and scored again only when newer events exist.
+*/
+func (m *Repository) otfVerdict(storeid int, anonymousID string) (models.OtfResult, error) {
+	cached, found, err := m.DB.GetOtfCache(anonymousID, storeid)
+	if err != nil {
+		return models.OtfResult{}, err
+	}
+	if found {
+		if time.Since(cached.UpdatedAt) < otfCacheTTL {
+			return cached.Result, nil
+		}
+		last, err := m.Clickhouse.GetLastEventTime(storeid, anonymousID)
+		if err != nil {
+			return models.OtfResult{}, err
+		}
+		if !last.After(cached.LastEventAt) {
+			if err = m.DB.TouchOtfCache(anonymousID, storeid); err != nil {
+				m.App.ErrorLog.Println(err)
+			}
+			return cached.Result, nil
+		}
 	}
+
+	vt, err := m.Clickhouse.PullStreamByAnonymousID(storeid, anonymousID)
+	if err != nil {
+		return models.OtfResult{}, err
+	}
+
+	conf, err := m.otfConfig(storeid)
+	if err != nil {
+		return models.OtfResult{}, err
+	}
+
 	// once we have that, we cacluate otf and respond!
-	otf, err := helpers.GetOtf(vt)
+	res := otf.Score(vt, conf, time.Now())
+
+	/* a failed cache write only costs a recompute on the next call */
+	err = m.DB.UpsertOtfCache(models.OtfCache{
+		AnonymousID: anonymousID,
+		Store:       storeid,
+		Visit:       vt,
+		Result:      res,
+		LastEventAt: vt.LastActionTime,
+	})
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to cache OTF verdict:", err)
+	}
+	return res, nil
+}
+
+/* otfConfig returns the store's OTF config or the default one */
+func (m *Repository) otfConfig(storeid int) (models.OtfConfig, error) {
+	conf, found, err := m.DB.GetOtfConfig(storeid)
+	if err != nil {
+		return conf, err
+	}
+	if !found {
+		conf = otf.DefaultConfig()
+		conf.Store = storeid
+	}
+	return conf, nil
+}
+
+func (m *Repository) GetOtfConfig(w http.ResponseWriter, r *http.Request) {
+	user := m.App.Session.Get(r.Context(), "user").(models.Users)
+	storeid := user.Store
+
+	conf, err := m.otfConfig(storeid)
+	if err != nil {
+		m.App.ErrorLog.Println("Unable to fetch OTF config")
+		helpers.ServerError(w, err)
+		return
+	}
+	jsonData, err := json.Marshal(conf)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+func (m *Repository) ConfigureOtf(w http.ResponseWriter, r *http.Request) {
+	user := m.App.Session.Get(r.Context(), "user").(models.Users)
+	storeid := user.Store
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	conf, err := m.otfConfig(storeid)
 	if err != nil {
+		m.App.ErrorLog.Println("Unable to fetch OTF config")
 		helpers.ServerError(w, err)
-		m.App.ErrorLog.Panicln("OTF naas", err)
+		return
 	}
-	if otf {
-		fmt.Fprintln(w, "Dikhao BC!")
-	} else {
-		fmt.Fprintln(w, "Mat dikaho BC!")
+
+	/* fields left out of the request keep their current value */
+	var requestBody struct {
+		Threshold *float64           `json:"threshold"`
+		Weights   *models.OtfWeights `json:"weights"`
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	if requestBody.Threshold != nil {
+		conf.Threshold = *requestBody.Threshold
+	}
+	if requestBody.Weights != nil {
+		conf.Weights = *requestBody.Weights
+	}
+	if err := otf.Validate(conf); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = m.DB.UpdateOtfConfig(conf)
+	if err != nil {
+		m.App.ErrorLog.Println("OTF config update failed!")
+		helpers.ServerError(w, err)
 	}
-	// then we store in postgres --> this should take 2 secs max, usse zyada liya to ma chud jaegi
 }
 
 // if login window and func for login post method is handled
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/helpers"
+	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/repository"
+)
+
+/* passwordRepo knows one user and their password, every other method panics */
+type passwordRepo struct {
+	repository.DatabaseRepo
+	email    string
+	password string
+	updated  string
+}
+
+func (p *passwordRepo) FetchUserByCreds(email string, pass string) (models.Users, bool, error) {
+	if email != p.email || pass != p.password {
+		return models.Users{}, false, nil
+	}
+	return models.Users{Email: email}, true, nil
+}
+
+func (p *passwordRepo) UpdatePassword(email string, pass string) error {
+	p.updated = pass
+	return nil
+}
+
+func TestUpdatePassword(t *testing.T) {
+	const email = "owner@example.com"
+	const newPassword = "Tidy-Otter-Lamp-42"
+
+	tests := []struct {
+		name       string
+		body       string
+		loginAt    time.Time // shopify login of the session, zero for a password login
+		wantStatus int
+	}{
+		{
+			name:       "current password",
+			body:       `{"current_password":"Old-Password-1","new_password":"` + newPassword + `"}`,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "wrong current password",
+			body:       `{"current_password":"Not-It-At-All-2","new_password":"` + newPassword + `"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "first password after shopify login",
+			body:       `{"new_password":"` + newPassword + `"}`,
+			loginAt:    time.Now().Add(-time.Minute),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "no current password after password login",
+			body:       `{"new_password":"` + newPassword + `"}`,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no current password after old shopify login",
+			body:       `{"new_password":"` + newPassword + `"}`,
+			loginAt:    time.Now().Add(-shopifyLoginWindow - time.Minute),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "wrong current password after shopify login",
+			body:       `{"current_password":"Not-It-At-All-2","new_password":"` + newPassword + `"}`,
+			loginAt:    time.Now().Add(-time.Minute),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "weak first password",
+			body:       `{"new_password":"short"}`,
+			loginAt:    time.Now().Add(-time.Minute),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &config.AppConfig{
+				Session:  scs.New(),
+				InfoLog:  log.New(io.Discard, "", 0),
+				ErrorLog: log.New(io.Discard, "", 0),
+			}
+			helpers.NewHelpers(app)
+			db := &passwordRepo{email: email, password: "Old-Password-1"}
+			m := &Repository{App: app, DB: db}
+
+			ctx, err := app.Session.Load(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.Session.Put(ctx, "user", models.Users{Email: email})
+			if !tt.loginAt.IsZero() {
+				app.Session.Put(ctx, "shopify_login_at", tt.loginAt)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/update_password", strings.NewReader(tt.body)).WithContext(ctx)
+			w := httptest.NewRecorder()
+			m.UpdatePassword(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			changed := tt.wantStatus == http.StatusNoContent
+			if changed != (db.updated == newPassword) {
+				t.Errorf("password updated to %q, want changed %v", db.updated, changed)
+			}
+			if changed && app.Session.Exists(ctx, "shopify_login_at") {
+				t.Error("the shopify login can still stand in for the new password")
+			}
+		})
+	}
+}
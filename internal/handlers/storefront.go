@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/malalwan/slaash/internal/collect"
+	"github.com/malalwan/slaash/internal/discounts"
+	"github.com/malalwan/slaash/internal/helpers"
+	"github.com/malalwan/slaash/internal/models"
+)
+
+/*
+Storefront handlers are called by the deal list widget from the shopper's
+browser. The store comes from the StorefrontAuth middleware, never a session.
+*/
+
+func (m *Repository) StorefrontOtf(w http.ResponseWriter, r *http.Request) {
+	store := helpers.StoreFromRequest(r)
+
+	anonymousID := r.URL.Query().Get("anonymous_id")
+	if anonymousID == "" {
+		http.Error(w, "anonymous_id is required", http.StatusBadRequest)
+		return
+	}
+
+	live, err := m.campaignLive(store)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch campaign status")
+		helpers.ServerError(w, err)
+		return
+	}
+
+	res := models.OtfResult{}
+	if store.DealListActive && live {
+		res, err = m.otfVerdict(store.ID, anonymousID)
+		if err != nil {
+			m.App.ErrorLog.Println("OTF scoring failed")
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	jsonData, err := json.Marshal(res)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+func (m *Repository) StorefrontDealList(w http.ResponseWriter, r *http.Request) {
+	store := helpers.StoreFromRequest(r)
+
+	dlInfo, err := m.DB.GetDealListInfo(store.ID)
+	if err != nil {
+		m.App.ErrorLog.Println("Unable to fetch deal list info")
+		helpers.ServerError(w, err)
+		return
+	}
+	jsonData, err := json.Marshal(dlInfo)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+/*
+campaignLive is false while the merchant has turned today's campaign off. A
+store the scheduler has not reached yet counts as live.
+*/
+func (m *Repository) campaignLive(store models.Store) (bool, error) {
+	status, found, err := m.DB.GetCampaignStatus(store.ID, time.Now())
+	if err != nil {
+		return false, err
+	}
+	return !found || status != "skipped", nil
+}
+
+/* funnelSteps in the order the widget reports them, each step needs the one before it */
+var funnelSteps = []string{"deal_shown", "deal_clicked", "code_shown", "code_copied"}
+
+/* funnelWindow is how long a shown deal stays one funnel, after that a new one starts */
+const funnelWindow = 24 * time.Hour
+
+/* funnelStage is the index of the last step done, -1 before the deal was shown */
+func funnelStage(v models.Visitor, found bool) int {
+	switch {
+	case !found:
+		return -1
+	case v.CodeCopied:
+		return 3
+	case v.CodeShown:
+		return 2
+	case v.DealClicked:
+		return 1
+	case v.DealShown:
+		return 0
+	}
+	return -1
+}
+
+/*
+StorefrontEvent records one funnel step for a visitor and product. Repeating a
+step that is already recorded is a no-op, skipping a step is refused with 409.
+code_shown is recorded by reveal_code since it hands out the code.
+*/
+func (m *Repository) StorefrontEvent(w http.ResponseWriter, r *http.Request) {
+	store := helpers.StoreFromRequest(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		AnonymousID string `json:"anonymous_id"`
+		ProductID   string `json:"product_id"`
+		Event       string `json:"event"`
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	productID, err := strconv.ParseInt(requestBody.ProductID, 10, 64)
+	if err != nil || requestBody.AnonymousID == "" {
+		http.Error(w, "anonymous_id and product_id are required", http.StatusBadRequest)
+		return
+	}
+	step := -1
+	for k, s := range funnelSteps {
+		if s == requestBody.Event {
+			step = k
+		}
+	}
+	if step < 0 || requestBody.Event == "code_shown" {
+		http.Error(w, "event must be deal_shown, deal_clicked or code_copied", http.StatusBadRequest)
+		return
+	}
+
+	v, found, err := m.DB.GetFunnel(store.ID, requestBody.AnonymousID, productID, time.Now().UTC().Add(-funnelWindow))
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to look up visitor funnel")
+		helpers.ServerError(w, err)
+		return
+	}
+	stage := funnelStage(v, found)
+	if step > stage+1 {
+		http.Error(w, funnelSteps[stage+1]+" must be recorded first", http.StatusConflict)
+		return
+	}
+
+	var response struct {
+		Event    string
+		Recorded bool
+	}
+	response.Event = requestBody.Event
+
+	if step == stage+1 {
+		now := time.Now().UTC()
+		if step == 0 {
+			_, err = m.DB.InsertVisitor(models.Visitor{
+				AnonymousID: requestBody.AnonymousID,
+				Store:       store.ID,
+				ProductId:   productID,
+				Timestamp:   now,
+				DealShown:   true,
+				DealShownAt: now,
+			})
+			response.Recorded = err == nil
+		} else {
+			/* false here means a concurrent call recorded it first */
+			response.Recorded, err = m.DB.AdvanceFunnel(v.ID, requestBody.Event)
+		}
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to record funnel event")
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+/*
+StorefrontRevealCode records the code_shown step and gives the visitor a code
+for the product, the same one on repeat calls. The deal must have been clicked.
+*/
+func (m *Repository) StorefrontRevealCode(w http.ResponseWriter, r *http.Request) {
+	store := helpers.StoreFromRequest(r)
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	var requestBody struct {
+		AnonymousID string `json:"anonymous_id"`
+		ProductID   string `json:"product_id"`
+		Timer       int8   `json:"timer_in_minutes"`
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	productID, err := strconv.ParseInt(requestBody.ProductID, 10, 64)
+	if err != nil || requestBody.AnonymousID == "" {
+		http.Error(w, "anonymous_id and product_id are required", http.StatusBadRequest)
+		return
+	}
+	live, err := m.campaignLive(store)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch campaign status")
+		helpers.ServerError(w, err)
+		return
+	}
+	if !store.DealListActive || !live {
+		helpers.ClientError(w, http.StatusForbidden)
+		return
+	}
+
+	v, found, err := m.DB.GetFunnel(store.ID, requestBody.AnonymousID, productID, time.Now().UTC().Add(-funnelWindow))
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to look up visitor funnel")
+		helpers.ServerError(w, err)
+		return
+	}
+	stage := funnelStage(v, found)
+	if stage < 1 {
+		http.Error(w, funnelSteps[stage+1]+" must be recorded first", http.StatusConflict)
+		return
+	}
+
+	var code models.DiscountCode
+	issued := false
+	if stage == 1 {
+		code, err = m.Codes.Issue(store, v, requestBody.Timer)
+		if errors.Is(err, discounts.ErrNoDiscount) {
+			helpers.ClientError(w, http.StatusNotFound)
+			return
+		}
+		if err != nil && !errors.Is(err, discounts.ErrCodeShown) {
+			m.App.ErrorLog.Println("Failed to issue discount code")
+			helpers.ServerError(w, err)
+			return
+		}
+		issued = err == nil
+	}
+	if !issued {
+		code, found, err = m.DB.GetLiveCodeForVisitor(store.ID, requestBody.AnonymousID, productID)
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to look up visitor code")
+			helpers.ServerError(w, err)
+			return
+		}
+		if !found {
+			/* the code ran out, a new funnel starts with the next deal_shown */
+			helpers.ClientError(w, http.StatusGone)
+			return
+		}
+	}
+
+	var response struct {
+		Code      string
+		ExpiresAt string
+	}
+	response.Code = code.Code
+	response.ExpiresAt = code.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z")
+
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
+
+const maxCollectBody = 1 << 20 // bytes, a full batch is far below this
+
+/*
+StorefrontCollect takes a batch of clickstream events from the storefront script
+for the OTF signals. A batch is accepted or refused whole, 503 with Retry-After
+means the buffer is full and the batch should be sent again later.
+*/
+func (m *Repository) StorefrontCollect(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCollectBody))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var requestBody struct {
+		Batch []models.ClickEvent `json:"batch"`
+	}
+
+	if err := json.Unmarshal(body, &requestBody); err != nil {
+		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		m.App.ErrorLog.Println(err)
+		return
+	}
+	if len(requestBody.Batch) == 0 || len(requestBody.Batch) > collect.MaxBatch {
+		http.Error(w, fmt.Sprintf("batch must have 1 to %d events", collect.MaxBatch), http.StatusBadRequest)
+		return
+	}
+	if err = collect.Validate(requestBody.Batch, helpers.StoreFromRequest(r).ID, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = m.Collector.Add(requestBody.Batch); errors.Is(err, collect.ErrFull) {
+		w.Header().Set("Retry-After", "5")
+		helpers.ClientError(w, http.StatusServiceUnavailable)
+		return
+	}
+
+	var response struct {
+		Accepted int
+	}
+	response.Accepted = len(requestBody.Batch)
+
+	jsonData, err := json.Marshal(response)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "%s\n", jsonData)
+}
@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	goshopify "github.com/bold-commerce/go-shopify/v3"
+	"github.com/go-chi/chi"
+	"github.com/malalwan/slaash/internal/helpers"
+	"github.com/malalwan/slaash/internal/models"
+	"github.com/shopspring/decimal"
+)
+
+/* webhookHandler handles the verified payload of one topic for a store */
+type webhookHandler func(m *Repository, store models.Store, body []byte) error
+
+/* webhookHandlers maps every topic in models.WebhookTopics to its handler */
+var webhookHandlers = map[string]webhookHandler{
+	"orders/create":    (*Repository).OrderCreated,
+	"checkouts/update": (*Repository).CheckoutUpdated,
+	"app/uninstalled":  (*Repository).AppUninstalled,
+	"products/update":  (*Repository).ProductUpdated,
+	"themes/publish":   (*Repository).ThemePublished,
+	"shop/update":      (*Repository).ShopUpdated,
+}
+
+/*
+ShopifyWebhook receives every webhook call from shopify
+Prerequisites: Store must have installed the app
+Input: Topic in the URL, Shopify headers, JSON payload
+Output: 200 once handled or a duplicate, 401 on a bad signature
+*/
+func (m *Repository) ShopifyWebhook(w http.ResponseWriter, r *http.Request) {
+	topic := fmt.Sprintf("%s/%s", chi.URLParam(r, "resource"), chi.URLParam(r, "event"))
+
+	ok, err := models.ShopifyApp().VerifyWebhookRequestVerbose(r)
+	if !ok {
+		m.App.ErrorLog.Println("Webhook HMAC verification failed:", err)
+		helpers.ClientError(w, http.StatusUnauthorized)
+		return
+	}
+
+	if h := r.Header.Get("X-Shopify-Topic"); h != "" && h != topic {
+		m.App.ErrorLog.Println("Webhook topic mismatch:", h, topic)
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	handler, found := webhookHandlers[topic]
+	if !found {
+		/* acknowledge so shopify stops retrying a topic we don't handle */
+		m.App.InfoLog.Println("No handler for webhook topic", topic)
+		return
+	}
+
+	shop := r.Header.Get("X-Shopify-Shop-Domain")
+	store, found, err := m.DB.GetStoreByName(shop)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to fetch store for webhook")
+		helpers.ServerError(w, err)
+		return
+	}
+	if !found {
+		m.App.InfoLog.Println("Webhook for unknown store", shop)
+		return
+	}
+
+	webhookID := r.Header.Get("X-Shopify-Webhook-Id")
+	if webhookID == "" {
+		helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+	fresh, err := m.DB.InsertWebhookDelivery(webhookID, shop, topic)
+	if err != nil {
+		m.App.ErrorLog.Println("Failed to record webhook delivery")
+		helpers.ServerError(w, err)
+		return
+	}
+	if !fresh {
+		m.App.InfoLog.Println("Dropping duplicate webhook", webhookID)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = handler(m, store, body)
+	}
+	if err != nil {
+		/* forget the delivery so that shopify's retry is handled again */
+		if dErr := m.DB.DeleteWebhookDelivery(webhookID); dErr != nil {
+			m.App.ErrorLog.Println(dErr)
+		}
+		m.App.ErrorLog.Println("Webhook handling failed for", topic)
+		helpers.ServerError(w, err)
+		return
+	}
+}
+
+/* OrderCreated records a checkout row per line item of orders that used a Slaash code */
+func (m *Repository) OrderCreated(store models.Store, body []byte) error {
+	var order goshopify.Order
+	if err := json.Unmarshal(body, &order); err != nil {
+		return err
+	}
+
+	code, found, err := m.slaashCode(store, order.DiscountCodes)
+	if err != nil || !found {
+		return err
+	}
+
+	anonymousID, err := m.DB.GetAnonymousIDByDiscountCode(store.ID, code.ShopifyID)
+	if err != nil {
+		return err
+	}
+	if anonymousID == "" {
+		m.App.InfoLog.Println("No visitor found for discount code", code.Code)
+	}
+
+	checkouts := checkoutsFromOrder(order, store.ID, code.ShopifyID, anonymousID)
+	m.App.InfoLog.Println("Order", order.ID, "attributed to code", code.Code, "for store", store.ID)
+	err = m.DB.InsertCheckouts(checkouts)
+	if err != nil {
+		return err
+	}
+	/* visitor codes are single use */
+	return m.Codes.Redeem(store, code)
+}
+
+/* slaashCode finds the first of the codes that Slaash created for the store */
+func (m *Repository) slaashCode(store models.Store, codes []goshopify.DiscountCode) (models.DiscountCode, bool, error) {
+	for _, dc := range codes {
+		c, ok, err := m.DB.GetDiscountCodeByCode(store.ID, dc.Code)
+		if err != nil || ok {
+			return c, ok, err
+		}
+	}
+	return models.DiscountCode{}, false, nil
+}
+
+/* checkoutsFromOrder splits an order into one Checkout per line item, amounts in cents */
+func checkoutsFromOrder(order goshopify.Order, storeid int, codeID int64, anonymousID string) []models.Checkout {
+	ts := time.Now()
+	if order.CreatedAt != nil {
+		ts = *order.CreatedAt
+	}
+
+	checkouts := []models.Checkout{}
+	for _, li := range order.LineItems {
+		price := decimal.Zero
+		if li.Price != nil {
+			price = *li.Price
+		}
+		gross := price.Mul(decimal.NewFromInt(int64(li.Quantity)))
+
+		discount := decimal.Zero
+		for _, da := range li.DiscountAllocations {
+			if da.Amount != nil {
+				discount = discount.Add(*da.Amount)
+			}
+		}
+		if len(li.DiscountAllocations) == 0 && li.TotalDiscount != nil {
+			discount = *li.TotalDiscount
+		}
+
+		checkouts = append(checkouts, models.Checkout{
+			AnonymousID:    anonymousID,
+			Store:          storeid,
+			OrderID:        order.ID,
+			LineItemID:     li.ID,
+			ProductID:      li.ProductID,
+			GMV:            gross.Sub(discount).Shift(2).Round(0).IntPart(),
+			DiscountAmount: discount.Shift(2).Round(0).IntPart(),
+			DiscountCode:   codeID,
+			Timestamp:      ts,
+		})
+	}
+	return checkouts
+}
+
+/* CheckoutUpdated records checkouts that carry a Slaash code, they are abandoned until completed */
+func (m *Repository) CheckoutUpdated(store models.Store, body []byte) error {
+	var checkout goshopify.AbandonedCheckout
+	if err := json.Unmarshal(body, &checkout); err != nil {
+		return err
+	}
+
+	code, found, err := m.slaashCode(store, checkout.DiscountCodes)
+	if err != nil || !found {
+		return err
+	}
+
+	anonymousID, err := m.DB.GetAnonymousIDByDiscountCode(store.ID, code.ShopifyID)
+	if err != nil {
+		return err
+	}
+	return m.DB.UpsertAbandonedCheckout(abandonedCheckout(checkout, store.ID, code.ShopifyID, anonymousID))
+}
+
+/* abandonedCheckout maps a checkout payload to its row, amounts in cents */
+func abandonedCheckout(checkout goshopify.AbandonedCheckout, storeid int, codeID int64, anonymousID string) models.AbandonedCheckout {
+	c := models.AbandonedCheckout{
+		CheckoutID:   checkout.ID,
+		Store:        storeid,
+		AnonymousID:  anonymousID,
+		DiscountCode: codeID,
+		UpdatedAt:    time.Now(),
+	}
+	if checkout.TotalPrice != nil {
+		c.TotalPrice = checkout.TotalPrice.Shift(2).Round(0).IntPart()
+	}
+	if checkout.TotalDiscounts != nil {
+		c.TotalDiscounts = checkout.TotalDiscounts.Shift(2).Round(0).IntPart()
+	}
+	if checkout.CompletedAt != nil {
+		c.CompletedAt = *checkout.CompletedAt
+	}
+	if checkout.UpdatedAt != nil {
+		c.UpdatedAt = *checkout.UpdatedAt
+	}
+	return c
+}
+
+func (m *Repository) AppUninstalled(store models.Store, body []byte) error {
+	var shop goshopify.Shop
+	if err := json.Unmarshal(body, &shop); err != nil {
+		return err
+	}
+	m.App.InfoLog.Println("App uninstalled by", shop.MyshopifyDomain)
+	return m.DB.UninstallStore(store.ID)
+}
+
+/*
+ProductUpdated forgets the cached collections of the product, so a collection
+discount it was added to or taken out of applies from its next code
+*/
+func (m *Repository) ProductUpdated(store models.Store, body []byte) error {
+	var product goshopify.Product
+	if err := json.Unmarshal(body, &product); err != nil {
+		return err
+	}
+	m.App.InfoLog.Println("Product", product.ID, "updated for store", store.ID)
+	m.Codes.ForgetProduct(store, product.ID)
+	return nil
+}
+
+/* ThemePublished puts the deal list on the newly published theme right away */
+func (m *Repository) ThemePublished(store models.Store, body []byte) error {
+	var published goshopify.Theme
+	if err := json.Unmarshal(body, &published); err != nil {
+		return err
+	}
+	m.App.InfoLog.Println("Theme", published.ID, "published for store", store.ID)
+	_, err := m.Themes.Reconcile(store, "system:themes/publish")
+	return err
+}
+
+/* ShopUpdated keeps the store timezone in sync, campaign times follow it */
+func (m *Repository) ShopUpdated(store models.Store, body []byte) error {
+	var shop goshopify.Shop
+	if err := json.Unmarshal(body, &shop); err != nil {
+		return err
+	}
+	if shop.IanaTimezone == "" || shop.IanaTimezone == store.Timezone {
+		return nil
+	}
+	m.App.InfoLog.Println("Timezone of", store.Name, "changed to", shop.IanaTimezone)
+	return m.DB.UpdateStoreTimezone(store.ID, shop.IanaTimezone)
+}
@@ -1,9 +1,17 @@
 package helpers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"regexp"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/malalwan/slaash/internal/config"
 	"github.com/malalwan/slaash/internal/models"
@@ -11,6 +19,12 @@ import (
 
 var app *config.AppConfig
 
+/* only a bare myshopify.com hostname is accepted as a shop */
+var shopHostname = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9\-]*\.myshopify\.com$`)
+
+/* how far a signed app proxy timestamp may be from now before the request is replayed */
+const proxyMaxSkew = 5 * time.Minute
+
 // NewHelpers sets up app config for helpers
 func NewHelpers(a *config.AppConfig) {
 	app = a
@@ -33,6 +47,181 @@ func IsAuthenticated(r *http.Request) bool {
 	return exists
 }
 
-func GetOtf(models.VisitTable) (bool, error) {
-	return true, nil
+/* contextKey keeps request context values private to this package */
+type contextKey string
+
+const storeContextKey contextKey = "store"
+
+// WithStore attaches the store a storefront request was authenticated for
+func WithStore(r *http.Request, store models.Store) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), storeContextKey, store))
+}
+
+// StoreFromRequest returns the store set by WithStore
+func StoreFromRequest(r *http.Request) models.Store {
+	store, _ := r.Context().Value(storeContextKey).(models.Store)
+	return store
+}
+
+// IsValidShop checks that the shop param is a myshopify.com hostname
+func IsValidShop(shop string) bool {
+	return shopHostname.MatchString(shop)
+}
+
+/*
+IsFreshProxyTimestamp checks the unix timestamp shopify signs into app proxy
+requests, a signed url older or newer than proxyMaxSkew is rejected.
+*/
+func IsFreshProxyTimestamp(ts string, now time.Time) bool {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	return skew <= proxyMaxSkew && skew >= -proxyMaxSkew
+}
+
+// NewNonce returns a random hex string, used as the oauth state
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewDiscountCode returns a random code that can't be guessed from another one
+func NewDiscountCode() (string, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return "", err
+	}
+	return "SL" + strings.ToUpper(nonce[:10]), nil
+}
+
+// IsValidDiscount reports whether perc can be the percentage of a discount
+func IsValidDiscount(perc int8) bool {
+	return perc >= 1 && perc <= 100
+}
+
+/* longest windows served, hourly series stay a few hundred points */
+const maxAnalyticsSpan = 366 * 24 * time.Hour
+const maxHourlySpan = 31 * 24 * time.Hour
+
+/* Units turns an amount in cents into the major units of its currency */
+func Units(cents int) float64 {
+	return float64(cents) / 100
+}
+
+/* UnitSeries turns a series of amounts in cents into major units */
+func UnitSeries(series map[string]int) map[string]float64 {
+	units := make(map[string]float64, len(series))
+	for k, v := range series {
+		units[k] = Units(v)
+	}
+	return units
+}
+
+/*
+ParseAnalyticsQuery builds the query of a dashboard chart from its request body.
+from and to are RFC3339 times or dates in the store's zone, a date as to is
+included whole. granularity defaults from the span and the comparison period
+defaults to the one right before. The old durationType values still work.
+*/
+func ParseAnalyticsQuery(body []byte, loc *time.Location, now time.Time) (models.AnalyticsQuery, error) {
+	var req struct {
+		DurationType string `json:"durationType"`
+		From         string `json:"from"`
+		To           string `json:"to"`
+		Granularity  string `json:"granularity"`
+		CompareFrom  string `json:"compare_from"`
+		CompareTo    string `json:"compare_to"`
+	}
+	q := models.AnalyticsQuery{Location: loc}
+
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return q, err
+		}
+	}
+
+	var err error
+	if req.From == "" {
+		/* the fixed ranges the dashboard used before from/to existed */
+		q.To = now
+		switch req.DurationType {
+		case "12hours":
+			q.From = now.Add(-12 * time.Hour)
+		case "weekly":
+			q.From = now.AddDate(0, 0, -7)
+		case "monthly":
+			q.From = now.AddDate(0, 0, -30)
+		default:
+			q.From = now.Add(-24 * time.Hour)
+		}
+	} else {
+		if q.From, err = parseQueryTime(req.From, loc, false); err != nil {
+			return q, err
+		}
+		q.To = now
+		if req.To != "" {
+			if q.To, err = parseQueryTime(req.To, loc, true); err != nil {
+				return q, err
+			}
+		}
+	}
+	span := q.To.Sub(q.From)
+	if span <= 0 || span > maxAnalyticsSpan {
+		return q, fmt.Errorf("from must be before to and at most a year apart")
+	}
+
+	q.Granularity = req.Granularity
+	switch q.Granularity {
+	case "":
+		q.Granularity = "week"
+		if span <= 48*time.Hour {
+			q.Granularity = "hour"
+		} else if span <= 62*24*time.Hour {
+			q.Granularity = "day"
+		}
+	case "hour", "day", "week":
+	default:
+		return q, fmt.Errorf("granularity must be hour, day or week")
+	}
+	if q.Granularity == "hour" && span > maxHourlySpan {
+		return q, fmt.Errorf("hourly series are limited to 31 days")
+	}
+
+	q.CompareFrom, q.CompareTo = q.From.Add(-span), q.From
+	if req.CompareFrom != "" {
+		if q.CompareFrom, err = parseQueryTime(req.CompareFrom, loc, false); err != nil {
+			return q, err
+		}
+		q.CompareTo = q.CompareFrom.Add(span)
+		if req.CompareTo != "" {
+			if q.CompareTo, err = parseQueryTime(req.CompareTo, loc, true); err != nil {
+				return q, err
+			}
+		}
+	}
+	if !q.CompareFrom.Before(q.CompareTo) {
+		return q, fmt.Errorf("compare_from must be before compare_to")
+	}
+	return q, nil
+}
+
+/* parseQueryTime reads an RFC3339 time or a date, end dates run to the next midnight */
+func parseQueryTime(s string, loc *time.Location, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, loc)
+	if err != nil {
+		return t, fmt.Errorf("%q is not a date or RFC3339 time", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
 }
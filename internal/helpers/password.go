@@ -0,0 +1,71 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const minPassword = 10      // characters
+const maxPassword = 72      // bytes, bcrypt ignores the rest
+const passphraseLength = 16 // long enough to need no character mix
+
+/* commonPasswords are refused outright, they are the first ones guessed */
+var commonPasswords = map[string]bool{
+	"1234567890": true, "0123456789": true, "qwertyuiop": true, "password12": true,
+	"password123": true, "password1234": true, "iloveyou123": true, "abcdefghij": true,
+	"letmein123": true, "welcome123": true, "shopify123": true, "slaash1234": true,
+}
+
+/*
+CheckPasswordStrength returns why a new dashboard password is refused, nil
+when it is fine. Passwords need 3 of lower case, upper case, digits and
+symbols, unless they are passphrases of 16 characters or more.
+*/
+func CheckPasswordStrength(pass string, email string) error {
+	if utf8.RuneCountInString(pass) < minPassword {
+		return fmt.Errorf("password must have at least %d characters", minPassword)
+	}
+	if len(pass) > maxPassword {
+		return fmt.Errorf("password must be at most %d bytes", maxPassword)
+	}
+
+	lower := strings.ToLower(pass)
+	if commonPasswords[lower] {
+		return errors.New("password is too common")
+	}
+	if name, _, _ := strings.Cut(strings.ToLower(email), "@"); len(name) >= 3 && strings.Contains(lower, name) {
+		return errors.New("password must not contain the email address")
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol bool
+	distinct := make(map[rune]bool)
+	for _, c := range pass {
+		distinct[c] = true
+		switch {
+		case unicode.IsLower(c):
+			hasLower = true
+		case unicode.IsUpper(c):
+			hasUpper = true
+		case unicode.IsDigit(c):
+			hasDigit = true
+		default:
+			hasSymbol = true
+		}
+	}
+	if len(distinct) < 5 {
+		return errors.New("password has too few different characters")
+	}
+	classes := 0
+	for _, has := range []bool{hasLower, hasUpper, hasDigit, hasSymbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < 3 && utf8.RuneCountInString(pass) < passphraseLength {
+		return fmt.Errorf("password needs 3 of lower case, upper case, digits and symbols, or %d characters", passphraseLength)
+	}
+	return nil
+}
@@ -0,0 +1,358 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Migrations are pairs of files named <version>_<name>.up.sql and .down.sql, one
+directory per database. The version is a UTC timestamp, migrations run in
+version order and each database records what it has applied in
+schema_migrations.
+*/
+
+const timeout = 5 * time.Minute // for a single migration
+
+var fileName = regexp.MustCompile(`^(\d{14})_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// ErrNoMigrations is returned by Down when nothing has been applied
+var ErrNoMigrations = errors.New("no applied migrations")
+
+// Migration is one version of the schema
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	Applied bool
+}
+
+/* Dialect is what differs between the databases migrations run against */
+type Dialect interface {
+	/* ensure creates schema_migrations if it doesn't exist */
+	ensure(ctx context.Context, db *sql.DB) error
+	/* applied lists the versions recorded in schema_migrations */
+	applied(ctx context.Context, db *sql.DB) (map[int64]bool, error)
+	/* run executes the script of m and records or removes its version */
+	run(ctx context.Context, db *sql.DB, m Migration, up bool) error
+}
+
+// Migrator runs the migrations of one directory against one database
+type Migrator struct {
+	DB      *sql.DB
+	Dir     string
+	Dialect Dialect
+}
+
+// New creates a migrator for the named database, postgres or clickhouse
+func New(database string, db *sql.DB, dir string) (*Migrator, error) {
+	m := &Migrator{DB: db, Dir: dir}
+	switch database {
+	case "postgres":
+		m.Dialect = postgres{}
+	case "clickhouse":
+		m.Dialect = clickhouse{}
+	default:
+		return nil, fmt.Errorf("unknown database %q", database)
+	}
+	return m, nil
+}
+
+// Status lists every migration in the directory and whether it was applied
+func (m *Migrator) Status() ([]Migration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ms, err := Load(os.DirFS(m.Dir))
+	if err != nil {
+		return nil, err
+	}
+	if err = m.Dialect.ensure(ctx, m.DB); err != nil {
+		return nil, err
+	}
+	applied, err := m.Dialect.applied(ctx, m.DB)
+	if err != nil {
+		return nil, err
+	}
+	for k := range ms {
+		ms[k].Applied = applied[ms[k].Version]
+	}
+	return ms, nil
+}
+
+/*
+Up applies pending migrations in version order, at most n when n > 0. It stops
+at the first failure and returns the migrations it applied.
+*/
+func (m *Migrator) Up(n int) ([]Migration, error) {
+	ms, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for _, mg := range ms {
+		if mg.Applied {
+			continue
+		}
+		if n > 0 && len(done) == n {
+			break
+		}
+		if err = m.apply(mg, true); err != nil {
+			return done, fmt.Errorf("%d_%s: %w", mg.Version, mg.Name, err)
+		}
+		done = append(done, mg)
+	}
+	return done, nil
+}
+
+// Down rolls back the last n applied migrations, newest first
+func (m *Migrator) Down(n int) ([]Migration, error) {
+	ms, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	done := []Migration{}
+	for k := len(ms) - 1; k >= 0 && len(done) < n; k-- {
+		if !ms[k].Applied {
+			continue
+		}
+		if err = m.apply(ms[k], false); err != nil {
+			return done, fmt.Errorf("%d_%s: %w", ms[k].Version, ms[k].Name, err)
+		}
+		done = append(done, ms[k])
+	}
+	if len(done) == 0 {
+		return done, ErrNoMigrations
+	}
+	return done, nil
+}
+
+func (m *Migrator) apply(mg Migration, up bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return m.Dialect.run(ctx, m.DB, mg, up)
+}
+
+// Create writes an empty up and down file for a new migration and returns their paths
+func Create(dir string, name string, now time.Time) ([]string, error) {
+	name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "_"))
+	base := now.UTC().Format("20060102150405") + "_" + name
+	if !fileName.MatchString(base + ".up.sql") {
+		return nil, fmt.Errorf("migration name %q may only have letters, digits and underscores", name)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, direction := range []string{"up", "down"} {
+		p := filepath.Join(dir, base+"."+direction+".sql")
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return paths, err
+		}
+		f.Close()
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// Load reads the migrations of a directory, every version needs both files
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		match := fileName.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		script, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mg, found := byVersion[version]
+		if !found {
+			mg = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mg
+		}
+		if mg.Name != match[2] {
+			return nil, fmt.Errorf("version %d is used by %s and %s", version, mg.Name, match[2])
+		}
+		if match[3] == "up" {
+			mg.Up = string(script)
+		} else {
+			mg.Down = string(script)
+		}
+	}
+
+	ms := []Migration{}
+	for _, mg := range byVersion {
+		if strings.TrimSpace(mg.Up) == "" {
+			return nil, fmt.Errorf("%d_%s has no up script", mg.Version, mg.Name)
+		}
+		ms = append(ms, *mg)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+/* postgres runs each migration and its schema_migrations row in one transaction */
+type postgres struct{}
+
+/* lockID keeps two migrators off the same postgres database at once */
+const lockID = 7202610180
+
+func (postgres) ensure(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			 version bigint PRIMARY KEY,
+			 name varchar(255) NOT NULL,
+			 applied_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'))`)
+	return err
+}
+
+func (postgres) applied(ctx context.Context, db *sql.DB) (map[int64]bool, error) {
+	return appliedVersions(ctx, db, `SELECT version FROM schema_migrations`)
+}
+
+func (postgres) run(ctx context.Context, db *sql.DB, m Migration, up bool) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	/* held until commit, a second migrator waits here and then sees the new row */
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, lockID); err != nil {
+		return err
+	}
+	var count int
+	err = tx.QueryRowContext(ctx, `SELECT count(*) FROM schema_migrations WHERE version = $1`, m.Version).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if (count == 1) == up {
+		return nil
+	}
+
+	script := m.Down
+	if up {
+		script = m.Up
+	}
+	/* no args, so the script goes out as one simple query and may hold many statements */
+	if strings.TrimSpace(script) != "" {
+		if _, err = tx.ExecContext(ctx, script); err != nil {
+			return err
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+clickhouse has no transactions around DDL, statements run one by one and the
+version is recorded after the last one. A failed migration is left half done
+and has to be fixed by hand, so clickhouse scripts should use IF NOT EXISTS.
+*/
+type clickhouse struct{}
+
+func (clickhouse) ensure(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			 version Int64,
+			 name String,
+			 applied UInt8,
+			 changed_at DateTime64(6, 'UTC'))
+			 ENGINE = ReplacingMergeTree(changed_at)
+			 ORDER BY version`)
+	return err
+}
+
+func (clickhouse) applied(ctx context.Context, db *sql.DB) (map[int64]bool, error) {
+	return appliedVersions(ctx, db, `SELECT version FROM schema_migrations FINAL WHERE applied = 1`)
+}
+
+func (clickhouse) run(ctx context.Context, db *sql.DB, m Migration, up bool) error {
+	script := m.Down
+	if up {
+		script = m.Up
+	}
+	for _, stmt := range splitStatements(script) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	applied := 0
+	if up {
+		applied = 1
+	}
+	/* the newest row of a version wins, down is recorded as a row with applied 0 */
+	_, err := db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied, changed_at)
+			 VALUES ($1, $2, $3, now64(6))`, m.Version, m.Name, applied)
+	return err
+}
+
+/*
+splitStatements breaks a clickhouse script into statements, which end with a
+semicolon at the end of a line. Lines starting with -- are comments.
+*/
+func splitStatements(script string) []string {
+	stmts := []string{}
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line + "\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+func appliedVersions(ctx context.Context, db *sql.DB, stmt string) (map[int64]bool, error) {
+	applied := make(map[int64]bool)
+	rows, err := db.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int64
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rows.Err()
+}
@@ -8,8 +8,8 @@ import (
 type Store struct {
 	ID                  int       // PK
 	Name                string    // abc.myshopify.com
-	ApiToken            string    // Needed to call shopify API
-	RefreshToken        string    // Needed to refresh the API token
+	ApiToken            string    // Needed to call shopify API, sealed, InitClient opens it
+	RefreshToken        string    // Needed to refresh the API token, sealed like ApiToken
 	Misc                string    // Extra info about the store
 	URL                 string    // store domain URL (www.abc.com)
 	PopupColorCode      string    // configured on the deal list
@@ -22,6 +22,32 @@ type Store struct {
 	CampaignTurnOffTime time.Time // add 1 day and then close camapaign for that day until renewal
 	DealListActive      bool      // global deal list toggle
 	Currency            string    // currency type for the store
+	PublicKey           string    // identifies the store to the storefront widget
+	Timezone            string    // IANA zone from shopify, campaign times are in it
+}
+
+/* Location is the store's timezone, UTC when unknown */
+func (store Store) Location() *time.Location {
+	loc, err := time.LoadLocation(store.Timezone)
+	if err != nil || store.Timezone == "" {
+		return time.UTC
+	}
+	return loc
+}
+
+/*
+CampaignStart returns when the store's campaign running at now started, in the
+store's timezone. Campaigns renew every day at CampaginRenewalTime wall clock
+time, so a day across a DST change is 23 or 25 hours long.
+*/
+func (store Store) CampaignStart(now time.Time) time.Time {
+	now = now.In(store.Location())
+	h, m, s := store.CampaginRenewalTime.Clock()
+	start := time.Date(now.Year(), now.Month(), now.Day(), h, m, s, 0, now.Location())
+	if start.After(now) {
+		start = start.AddDate(0, 0, -1)
+	}
+	return start
 }
 
 /* User stores the information of the person accessing the dashboard */
@@ -45,10 +71,14 @@ type DiscountCode struct {
 	PriceRuleID int64     // Price rule used to create the discount
 	Code        string    // Discount code string to be sent over channels
 	Timestamp   time.Time // Update when the code is modified as well
+	Pooled      bool      // Single use code pre-generated for visitors
+	IssuedAt    time.Time // When a pooled code was handed to a visitor
+	ExpiresAt   time.Time // Issued code is revoked after this
 }
 
 /* Visitor stores the first moment of truth for a visitor who sees the deal list popup */
 type Visitor struct {
+	ID             int64     // one row per funnel, a visitor can have many
 	AnonymousID    string    // not pk
 	Store          int       // Store details on which the deal list was clicked
 	ProductId      int64     // Product ID of the product where the deal list was shown
@@ -60,25 +90,51 @@ type Visitor struct {
 	CodeShown      bool      // code dikha ya nhi
 	CodeCopied     bool      // Code copy kiya ya nahi
 	Misc           string    // Extra info about the buyer
+	DealShownAt    time.Time // when each funnel step happened, zero if not yet
+	DealClickedAt  time.Time
+	CodeShownAt    time.Time
+	CodeCopiedAt   time.Time
 }
 
-/* Checkout is populated at every checkout from Slaash discount coupons */
+/*
+Checkout is populated at every checkout from Slaash discount coupons. Amounts
+are in hundredths of the store currency (cents), and so is every gmv and
+discount figure derived from them.
+*/
 type Checkout struct {
 	AnonymousID    string    // visitor id
 	Store          int       // store ref
+	OrderID        int64     // shopify order the checkout came from
+	LineItemID     int64     // shopify line item, one row per line item
 	ProductID      int64     // product ref
-	GMV            int       // gmv driven by the product (final checkout value)
-	DiscountAmount int       // disocunt amount given on the product
+	GMV            int64     // gmv driven by the product (final checkout value), cents
+	DiscountAmount int64     // disocunt amount given on the product, cents
 	DiscountCode   int64     // code that was applied on the product
 	Timestamp      time.Time // checkout time
 }
 
+/*
+AbandonedCheckout is the latest state of a shopify checkout that carries a
+Slaash code, it stays abandoned until CompletedAt is set. Amounts are in cents.
+*/
+type AbandonedCheckout struct {
+	CheckoutID     int64     // shopify checkout id
+	Store          int       // store ref
+	AnonymousID    string    // visitor the code was issued to
+	DiscountCode   int64     // slaash code on the checkout
+	TotalPrice     int64     // checkout total, cents
+	TotalDiscounts int64     // discounts on the checkout, cents
+	CompletedAt    time.Time // zero while the checkout is abandoned
+	UpdatedAt      time.Time // last change on shopify
+}
+
 /* Product is populated when a discount is associated with it by the user */
 type Product struct {
 	ProductID          int64 // shopify product ID
 	Store              int   // Store id we created
 	DiscountPercentage int8  // number entered by the user
-	DiscountCode       int64 // we generate this and attach id of the code here, can fetch code from shopify/our db
+	PriceRuleID        int64 // shopify price rule the visitor codes are generated under
+	DiscountCode       int64 // shopify id of the product's own code, never shown to visitors
 	Impressions        int64 // deal list impressions for each product, redundant but aggregated
 }
 
@@ -87,6 +143,123 @@ type Collection struct {
 	Store              int   // store id
 	CollectionID       int64 //check in shopify
 	DiscountPercentage int8  // percentage configured
-	DiscountCode       int64 // code that was applied
+	PriceRuleID        int64 // shopify price rule the visitor codes are generated under
+	DiscountCode       int64 // shopify id of the collection's own code, never shown to visitors
 	Impressions        int64 // number of hits for each collection (aggregation makes sense here)
 }
+
+/* RetiredPriceRule is the price rule of a removed discount still to be deleted on shopify */
+type RetiredPriceRule struct {
+	Store       int
+	PriceRuleID int64
+	RetiredAt   time.Time
+}
+
+/* OtfWeights is the weight of every VisitTable signal in the OTF score */
+type OtfWeights struct {
+	ScrollDepth      float64 `json:"scroll_depth"`      // max scroll depth on a page
+	AddToCarts       float64 `json:"add_to_carts"`      // items added to the cart
+	ImageClicks      float64 `json:"image_clicks"`      // product image clicks
+	Pages            float64 `json:"pages"`             // pages visited
+	IndividualVisits float64 `json:"individual_visits"` // sessions on the store
+	Clicks           float64 `json:"clicks"`            // total clicks
+	ClickDistance    float64 `json:"click_distance"`    // closer clicks mean focused browsing
+	Recency          float64 `json:"recency"`           // how recent the last action was
+}
+
+/* OtfConfig is the per store OTF scoring setup */
+type OtfConfig struct {
+	Store     int        // store ref
+	Threshold float64    // score at or above which the deal list is shown
+	Weights   OtfWeights // signal weights
+}
+
+/* OtfCache is the last OTF verdict computed for a visitor of a store */
+type OtfCache struct {
+	AnonymousID string     // visitor device id
+	Store       int        // store ref
+	Visit       VisitTable // aggregated clickstream the verdict was computed from
+	Result      OtfResult  // score, threshold and verdict
+	LastEventAt time.Time  // newest clickstream event considered
+	UpdatedAt   time.Time  // when the verdict was last computed or confirmed
+}
+
+/* ThemeDeployment is one push of a slaash asset to a store's theme */
+type ThemeDeployment struct {
+	ID              int64
+	Store           int
+	ThemeID         int64
+	AssetKey        string
+	ContentHash     string // sha256 of Content
+	Content         string
+	PreviousContent string // what the asset held before, empty if it didn't exist
+	TriggeredBy     string // email of the user, or "system"
+	RollbackOf      int64  // deployment this one reverted, 0 for regular pushes
+	CreatedAt       time.Time
+}
+
+/* ClickEvent is one posthog style event for the Clickstream table */
+type ClickEvent struct {
+	UUID       string                 `json:"uuid"`      // set on receipt, lets retried writes be deduplicated
+	Store      int                    `json:"store"`     // set on receipt to the store the request was authenticated for
+	DeviceID   string                 `json:"device_id"` // set on receipt from the $device_id property
+	Event      string                 `json:"event"`
+	Properties map[string]interface{} `json:"properties"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+/*
+AnalyticsQuery is the window of a dashboard chart and the period it is compared
+with. From is inclusive and To exclusive. Buckets start on the hour, at midnight
+or on monday midnight in Location.
+*/
+type AnalyticsQuery struct {
+	From        time.Time
+	To          time.Time
+	Granularity string // hour, day or week
+	CompareFrom time.Time
+	CompareTo   time.Time
+	Location    *time.Location
+}
+
+/*
+SeriesKeyFormat is how bucket starts are written as series keys. The offset
+keeps the two hours that share a wall clock time on a DST fall-back apart.
+*/
+const SeriesKeyFormat = "2006-01-02 15:04:05-07:00"
+
+/* SeriesKey is the series key of the bucket starting at t, in the store's zone */
+func (q AnalyticsQuery) SeriesKey(t time.Time) string {
+	return t.In(q.Location).Format(SeriesKeyFormat)
+}
+
+/* Bucket returns the start of the bucket t falls in */
+func (q AnalyticsQuery) Bucket(t time.Time) time.Time {
+	t = t.In(q.Location)
+	switch q.Granularity {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, q.Location)
+	case "week":
+		monday := t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+		return time.Date(monday.Year(), monday.Month(), monday.Day(), 0, 0, 0, 0, q.Location)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.Location)
+}
+
+/* EmptySeries has a zero for every bucket between From and To, so charts have no gaps */
+func (q AnalyticsQuery) EmptySeries() map[string]int {
+	series := make(map[string]int)
+	for t := q.Bucket(q.From); t.Before(q.To); {
+		series[q.SeriesKey(t)] = 0
+		switch q.Granularity {
+		case "hour":
+			/* absolute hours, wall clock hours repeat or vanish on DST days */
+			t = t.Add(time.Hour)
+		case "week":
+			t = t.AddDate(0, 0, 7)
+		default:
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	return series
+}
@@ -6,6 +6,8 @@ import "time"
 send data back to the dashboard as Json
 All unique responses need to be defined
 here for better visibility on the handlers
+Money is kept in cents in the DBs and sent
+in the major units of the store currency
 */
 
 /* Json map for top 5 products list */
@@ -15,11 +17,11 @@ type TopProducts struct {
 		ProductImage string
 		Users        int
 		Discount     struct {
-			Value        int
+			Value        float64
 			CurrencyType string
 		}
 		Gmv struct {
-			Value        int
+			Value        float64
 			CurrencyType string
 		}
 	}
@@ -28,11 +30,11 @@ type TopProducts struct {
 /* Json map for active campaign stats */
 type CampaignActivity struct {
 	Discount struct {
-		Value int
+		Value float64
 	}
 	GmvActiveSession struct {
 		CurrencyType string
-		Value        int
+		Value        float64
 		GmvVertical  struct {
 			Positive         bool
 			ChangePercentage float32
@@ -61,7 +63,7 @@ type CampaignActivity struct {
 /* Json map for graphs + aggregate for overall stats */
 type DealListActivity struct {
 	Gmv struct {
-		Price       int
+		Price       float64
 		GmvVertical struct {
 			VerticalVal float32
 			GmvVertical bool
@@ -82,19 +84,19 @@ type DealListActivity struct {
 		}
 	}
 	DiscountSpends struct {
-		Price                  int
+		Price                  float64
 		DiscountSpendsVertical struct {
 			VerticalVal            float32
 			DiscountSpendsVertical bool
 		}
 	}
-	GmvData map[string]int
+	GmvData map[string]float64
 
 	ProductsData map[string]int
 
 	UsersData map[string]int
 
-	DiscountsData map[string]int
+	DiscountsData map[string]float64
 }
 
 /* Json for OTF graph */
@@ -121,6 +123,14 @@ type UserProfile struct {
 	PhotoURL  string
 }
 
+/* Json for the OTF verdict of a visitor */
+type OtfResult struct {
+	Score         float64
+	Threshold     float64
+	Otf           bool
+	Contributions map[string]float64
+}
+
 /* VisitTable is the mapping for OTF algorithm and is used to cache that info in Postgres */
 type VisitTable struct {
 	AnonymousID      string
@@ -148,15 +158,28 @@ type VisitTable struct {
 }
 
 type Campaign struct {
+	ID                    int
+	Status                string // open, closed or skipped (turned off by the merchant)
+	DefaultDiscount       int8   // discount settings when the campaign opened
+	DiscountCategory      int8
+	MaxDiscount           int8
 	StartTime             time.Time
 	EndTime               time.Time
-	DiscountValue         float32
-	GmvValue              float32
+	DiscountValue         float32 // in cents, sent in major units
+	GmvValue              float32 // in cents, sent in major units
 	Users                 int
 	Products              int
-	Aov                   float32
+	Aov                   float32 // in cents, sent in major units
 	Impressions           int64
 	PromoCopied           int64
 	SuccessfulRedemptions int64
 	Conversions           int64
 }
+
+/* Comparison is one metric over a window and the period it is compared with */
+type Comparison struct {
+	Current  int
+	Previous int
+	Change   float32 // percent change from Previous
+	Up       bool    // Current >= Previous
+}
@@ -1,203 +1,298 @@
 package models
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	goshopify "github.com/bold-commerce/go-shopify/v3"
 	"github.com/malalwan/slaash/internal/config"
+	"github.com/shopspring/decimal"
 )
 
 var app *config.AppConfig
 
+/* WebhookTopics are registered for every store on install, each needs a handler */
+var WebhookTopics = []string{
+	"orders/create",
+	"checkouts/update",
+	"app/uninstalled",
+	"products/update",
+	"themes/publish",
+	"shop/update",
+}
+
 // NewHelpers sets up app config for helpers
 func NewShopifyFunctions(a *config.AppConfig) {
 	app = a
 }
 
-func (store Store) InitClient() *goshopify.Client {
-	app := goshopify.App{
-		ApiKey:    app.MyAppCreds[0],
-		ApiSecret: app.MyAppCreds[1],
+// ShopifyApp returns the shopify app built from our credentials
+func ShopifyApp() goshopify.App {
+	return goshopify.App{
+		ApiKey:      app.MyAppCreds[0],
+		ApiSecret:   app.MyAppCreds[1],
+		RedirectUrl: app.RedirectURL,
 	}
-	client := goshopify.NewClient(app, store.Name, store.ApiToken)
-	return client
 }
 
-func (store Store) SendUItoTheme(js string) error {
-	client := store.InitClient()
-	themes, err := client.Theme.List(client.Theme)
+/* TokenContext binds a sealed token to its store and column, so it won't open in another row */
+func (store Store) TokenContext(column string) string {
+	return "store:" + store.Name + ":" + column
+}
+
+/* SetApiToken seals an access token from shopify into the store */
+func (store *Store) SetApiToken(token string) error {
+	sealed, err := app.Tokens.Seal(token, store.TokenContext("api_token"))
 	if err != nil {
-		fmt.Println("Error retrieving themes:", err)
 		return err
 	}
+	store.ApiToken = sealed
+	return nil
+}
 
-	var activeThemeID int64
-	for _, theme := range themes {
-		if theme.Role == "main" { // 'main' role indicates the active theme
-			activeThemeID = theme.ID
-			break
-		}
+/* InitClient opens the store's access token, the only place it is decrypted */
+func (store Store) InitClient() (*goshopify.Client, error) {
+	token, err := app.Tokens.Open(store.ApiToken, store.TokenContext("api_token"))
+	if err != nil {
+		return nil, fmt.Errorf("can't open the api token of %s: %w", store.Name, err)
 	}
+	client := goshopify.NewClient(ShopifyApp(), store.Name, token)
+	return client, nil
+}
 
-	if activeThemeID == 0 {
-		fmt.Println("Active theme not found")
-		return err
+func (store Store) GetShopInfo() (*goshopify.Shop, error) {
+
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = client.Theme.Get(activeThemeID, client.Theme)
+	shop, err := goshopify.ShopService.Get(client.Shop, nil)
+
+	return shop, err
+}
+
+/* MainThemeID finds the published theme, the one shoppers see */
+func (store Store) MainThemeID() (int64, error) {
+	client, err := store.InitClient()
 	if err != nil {
-		fmt.Println("Error retrieving active theme:", err)
-		return err
+		return 0, err
+	}
+	themes, err := client.Theme.List(nil)
+	if err != nil {
+		return 0, err
 	}
 
-	assetKey := "assets/global.js"
+	for _, theme := range themes {
+		if theme.Role == "main" { // 'main' role indicates the active theme
+			return theme.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("no published theme on %s", store.Name)
+}
 
-	asset := goshopify.Asset{
-		ThemeID: activeThemeID,
-		Value:   js,
-		Key:     assetKey,
+func (store Store) GetThemeAsset(themeID int64, key string) (string, error) {
+	client, err := store.InitClient()
+	if err != nil {
+		return "", err
 	}
 
-	_, err = client.Asset.Update(activeThemeID, asset)
+	asset, err := client.Asset.Get(themeID, key)
+	if err != nil {
+		return "", err
+	}
+	return asset.Value, nil
+}
 
+func (store Store) PutThemeAsset(themeID int64, key string, value string) error {
+	client, err := store.InitClient()
 	if err != nil {
-		fmt.Println("Error here!")
-		log.Fatal(err)
 		return err
 	}
 
-	fmt.Println("Updated asset name!")
+	asset := goshopify.Asset{
+		ThemeID: themeID,
+		Value:   value,
+		Key:     key,
+	}
 
-	return nil
+	_, err = client.Asset.Update(themeID, asset)
+
+	return err
 }
 
 func (store Store) CreatePriceRule(pr goshopify.PriceRule) (int64, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return 0, err
+	}
 
 	newPriceRule, err := goshopify.PriceRuleService.Create(client.PriceRule, pr)
 	if err != nil {
-		log.Fatalf("Failed to create price rule: %s", err)
+		return 0, err
 	}
 
-	fmt.Printf("Price rule created with ID: %d\n", newPriceRule.ID)
-	// DB calls here
+	app.InfoLog.Printf("Price rule %d created on %s", newPriceRule.ID, store.Name)
 
 	return newPriceRule.ID, nil
 }
 
-func (store Store) SendJsToGlobal(js string) error {
-	client := store.InitClient()
-	themes, err := client.Theme.List(client.Theme)
+func (store Store) UpdatePriceRule(pr goshopify.PriceRule) error {
+
+	client, err := store.InitClient()
 	if err != nil {
-		fmt.Println("Error retrieving themes:", err)
 		return err
 	}
 
-	var activeThemeID int64
-	for _, theme := range themes {
-		if theme.Role == "main" { // 'main' role indicates the active theme
-			activeThemeID = theme.ID
-			break
-		}
-	}
+	_, err = goshopify.PriceRuleService.Update(client.PriceRule, pr)
 
-	if activeThemeID == 0 {
-		fmt.Println("Active theme not found")
-		return err
-	}
+	return err
+}
 
-	_, err = client.Theme.Get(activeThemeID, client.Theme)
+/* LimitPriceRule makes every code under the price rule single use and once per customer */
+func (store Store) LimitPriceRule(prId int64) error {
+	return store.UpdatePriceRule(goshopify.PriceRule{ID: prId, UsageLimit: 1, OncePerCustomer: true})
+}
+
+/* DeletePriceRule removes the price rule along with all of its codes, a rule already gone is not an error */
+func (store Store) DeletePriceRule(prId int64) error {
+
+	client, err := store.InitClient()
 	if err != nil {
-		fmt.Println("Error retrieving active theme:", err)
 		return err
 	}
 
-	assetKey := "assets/global-slaash.js"
-
-	asset := goshopify.Asset{
-		ThemeID: activeThemeID,
-		Value:   js,
-		Key:     assetKey,
+	err = goshopify.PriceRuleService.Delete(client.PriceRule, prId)
+	var re goshopify.ResponseError
+	if errors.As(err, &re) && re.Status == http.StatusNotFound {
+		return nil
 	}
 
-	_, err = client.Asset.Update(activeThemeID, asset)
+	return err
+}
+
+/*
+NewDiscountPriceRule builds a percentage price rule for the whole store (cat 1),
+one product (cat 2) or one collection (cat 3). Every code under it is single
+use and once per customer.
+*/
+func NewDiscountPriceRule(title string, cat int8, ident int64, perc int8) goshopify.PriceRule {
+	value := decimal.NewFromInt(-int64(perc))
+	now := time.Now()
+	pr := goshopify.PriceRule{
+		Title:             title,
+		ValueType:         "percentage",
+		Value:             &value,
+		CustomerSelection: "all",
+		TargetType:        "line_item",
+		TargetSelection:   "entitled",
+		AllocationMethod:  "each",
+		UsageLimit:        1,
+		OncePerCustomer:   true,
+		StartsAt:          &now,
+	}
+	switch cat {
+	case 1:
+		pr.TargetSelection = "all"
+	case 2:
+		pr.EntitledProductIds = []int64{ident}
+	case 3:
+		pr.EntitledCollectionIds = []int64{ident}
+	}
+	return pr
+}
 
+func (store Store) DeleteThemeAsset(themeID int64, key string) error {
+	client, err := store.InitClient()
 	if err != nil {
-		fmt.Println("Error here!")
 		return err
 	}
 
-	fmt.Println("Updated asset name!")
-
-	return nil
+	return client.Asset.Delete(themeID, key)
 }
 
 func (store Store) FetchPriceRules() ([]goshopify.PriceRule, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	priceRuleList, err := goshopify.PriceRuleService.List(client.PriceRule)
-
 	if err != nil {
-		log.Fatalf("Failed to fetch price rules: %s", err)
+		return nil, fmt.Errorf("can't fetch the price rules of %s: %w", store.Name, err)
 	}
 
 	return priceRuleList, nil
 }
 
-func (store Store) CreateDiscountByPrID(prId int64, d goshopify.PriceRuleDiscountCode) (int, error) {
+func (store Store) CreateDiscountByPrID(prId int64, d goshopify.PriceRuleDiscountCode) (int64, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return 0, err
+	}
 
 	newD, err := goshopify.DiscountCodeService.Create(client.DiscountCode, prId, d)
 	if err != nil {
-		log.Fatalf("Failed to create price rule: %s", err)
+		return 0, err
 	}
 
-	fmt.Printf("Discount Code created with ID: %d\n", newD.ID)
-	// DB calls here
+	app.InfoLog.Printf("Discount code %d created on %s", newD.ID, store.Name)
 
-	return 0, nil
+	return newD.ID, nil
 }
 
 func (store Store) DeleteDiscountByDiscId(dId int64, prId int64) error {
 
-	client := store.InitClient()
-
-	err := goshopify.DiscountCodeService.Delete(client.DiscountCode, dId, prId)
+	client, err := store.InitClient()
 	if err != nil {
-		log.Fatalf("Failed to delete discount code: %s", err)
+		return err
 	}
-	return nil
+
+	err = goshopify.DiscountCodeService.Delete(client.DiscountCode, prId, dId)
+
+	return err
 }
 
 func (store Store) FetchDiscountsByPrId(prId int64) ([]goshopify.PriceRuleDiscountCode, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	dList, err := goshopify.DiscountCodeService.List(client.DiscountCode, prId)
 	if err != nil {
-		log.Fatalf("Failed to create price rule: %s", err)
+		return nil, fmt.Errorf("can't fetch the discount codes of price rule %d: %w", prId, err)
 	}
 	return dList, nil
 }
 
 func (store Store) GetOrderData() ([]goshopify.Order, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 	var intf interface{}
 	orders, err := goshopify.OrderService.List(client.Order, intf)
 	if err != nil {
-		log.Fatalf("Failed to retrieve order list: %s", err)
+		return nil, fmt.Errorf("can't fetch the orders of %s: %w", store.Name, err)
 	}
 	return orders, nil
 }
 
 func (store Store) GetCustomerByCustId(CustId int64) (*goshopify.Customer, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	customer, err := goshopify.CustomerService.Get(client.Customer, CustId, 0)
 
@@ -206,7 +301,10 @@ func (store Store) GetCustomerByCustId(CustId int64) (*goshopify.Customer, error
 
 func (store Store) RetrieveAbandonedCheckouts() ([]goshopify.AbandonedCheckout, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	AbanCheckouts, err := goshopify.AbandonedCheckoutService.List(client.AbandonedCheckout, 0)
 
@@ -215,7 +313,10 @@ func (store Store) RetrieveAbandonedCheckouts() ([]goshopify.AbandonedCheckout,
 
 func (store Store) GetProductById(PId int64) (*goshopify.Product, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	product, err := goshopify.ProductService.Get(client.Product, PId, 0)
 
@@ -224,7 +325,10 @@ func (store Store) GetProductById(PId int64) (*goshopify.Product, error) {
 
 func (store Store) GetAllProducts() ([]goshopify.Product, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 	listOptions := goshopify.ProductListOptions{
 		PublishedStatus: "published",
 	}
@@ -237,19 +341,24 @@ func (store Store) GetAllProducts() ([]goshopify.Product, error) {
 
 func (store Store) GetAllCustomers() ([]goshopify.Customer, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	customers, err := goshopify.CustomerService.List(client.Customer, nil)
-
 	if err != nil {
-		log.Fatalf("Failed to retrieve order list: %s", err)
+		return nil, fmt.Errorf("can't fetch the customers of %s: %w", store.Name, err)
 	}
 	return customers, nil
 }
 
 func (store Store) GetOrdersByCustomerId(CustId int64) ([]goshopify.Order, error) {
 
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	orders, err := goshopify.CustomerService.ListOrders(client.Customer, CustId, 0)
 
@@ -258,7 +367,10 @@ func (store Store) GetOrdersByCustomerId(CustId int64) ([]goshopify.Order, error
 }
 
 func (store Store) CreateWebhook(w goshopify.Webhook) (*goshopify.Webhook, error) {
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	// sample webhook:
 	// webhook := shopify.Webhook{
@@ -272,10 +384,21 @@ func (store Store) CreateWebhook(w goshopify.Webhook) (*goshopify.Webhook, error
 	return newW, err
 }
 
+func (store Store) DeleteWebhook(id int64) error {
+	client, err := store.InitClient()
+	if err != nil {
+		return err
+	}
+	return goshopify.WebhookService.Delete(client.Webhook, id)
+}
+
 // Webhook to get a notification when a checkout happens or is dropped
 
 func (store Store) RetrieveAllWebhooks() ([]goshopify.Webhook, error) {
-	client := store.InitClient()
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
 
 	listOptions := goshopify.ListOptions{
 		Limit: 10, // Number of items per page
@@ -287,3 +410,66 @@ func (store Store) RetrieveAllWebhooks() ([]goshopify.Webhook, error) {
 
 	return webhooks, error
 }
+
+/*
+RegisterWebhooks subscribes the store to all WebhookTopics it is missing and
+drops our subscriptions to topics no longer in the list
+*/
+func (store Store) RegisterWebhooks() error {
+	existing, err := store.RetrieveAllWebhooks()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, topic := range WebhookTopics {
+		wanted[topic] = true
+	}
+	registered := make(map[string]bool)
+	for _, w := range existing {
+		if !wanted[w.Topic] && strings.HasPrefix(w.Address, app.WebhookURL+"/") {
+			if err = store.DeleteWebhook(w.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		registered[w.Topic] = true
+	}
+
+	for _, topic := range WebhookTopics {
+		if registered[topic] {
+			continue
+		}
+		_, err = store.CreateWebhook(goshopify.Webhook{
+			Topic:   topic,
+			Address: fmt.Sprintf("%s/%s", app.WebhookURL, topic),
+			Format:  "json",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store Store) GetCollectionIDsByProduct(PId int64) ([]int64, error) {
+	client, err := store.InitClient()
+	if err != nil {
+		return nil, err
+	}
+
+	listOptions := struct {
+		ProductID int64 `url:"product_id"`
+	}{PId}
+
+	collects, err := goshopify.CollectService.List(client.Collect, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int64{}
+	for _, c := range collects {
+		ids = append(ids, c.CollectionID)
+	}
+	return ids, nil
+}
@@ -0,0 +1,140 @@
+package otf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/malalwan/slaash/internal/models"
+)
+
+/* every signal is scaled to 0..1, reaching 1 at these values */
+const scrollCap = 100           // percent of the page
+const addToCartCap = 3          // items
+const imageClickCap = 10        // clicks
+const pageCap = 8               // pages
+const visitCap = 4              // sessions
+const clickCap = 40             // clicks
+const clickDistanceCap = 800    // pixels, at or beyond this the signal is 0
+const recencyWindow = 30 * 60.0 // seconds, older actions score 0
+
+// DefaultConfig is used for stores that have not tuned OTF scoring
+func DefaultConfig() models.OtfConfig {
+	return models.OtfConfig{
+		Threshold: 0.5,
+		Weights: models.OtfWeights{
+			ScrollDepth:      0.15,
+			AddToCarts:       0.25,
+			ImageClicks:      0.15,
+			Pages:            0.10,
+			IndividualVisits: 0.10,
+			Clicks:           0.05,
+			ClickDistance:    0.05,
+			Recency:          0.15,
+		},
+	}
+}
+
+/*
+Validate checks a config before it is saved. The threshold is within 0..1, no
+weight is negative and the weights don't sum to 0, which would score everyone 0.
+*/
+func Validate(c models.OtfConfig) error {
+	if math.IsNaN(c.Threshold) || c.Threshold < 0 || c.Threshold > 1 {
+		return errors.New("threshold must be between 0 and 1")
+	}
+	w := c.Weights
+	weights := []struct {
+		name   string
+		weight float64
+	}{
+		{"scroll_depth", w.ScrollDepth},
+		{"add_to_carts", w.AddToCarts},
+		{"image_clicks", w.ImageClicks},
+		{"pages", w.Pages},
+		{"individual_visits", w.IndividualVisits},
+		{"clicks", w.Clicks},
+		{"click_distance", w.ClickDistance},
+		{"recency", w.Recency},
+	}
+	total := 0.0
+	for _, x := range weights {
+		if math.IsNaN(x.weight) || math.IsInf(x.weight, 0) || x.weight < 0 {
+			return fmt.Errorf("weight %s must be a non-negative number", x.name)
+		}
+		total += x.weight
+	}
+	if total <= 0 {
+		return errors.New("at least one weight must be positive")
+	}
+	return nil
+}
+
+/*
+Score computes the weighted OTF score of a visitor
+Every signal is scaled to 0..1 and multiplied by its weight, the score is the
+sum divided by the total weight so thresholds stay within 0..1
+*/
+func Score(vt models.VisitTable, c models.OtfConfig, now time.Time) models.OtfResult {
+	w := c.Weights
+	signals := []struct {
+		name   string
+		weight float64
+		value  float64
+	}{
+		{"scroll_depth", w.ScrollDepth, scale(float64(vt.MaxScrollDepth), scrollCap)},
+		{"add_to_carts", w.AddToCarts, scale(float64(vt.AddToCarts), addToCartCap)},
+		{"image_clicks", w.ImageClicks, scale(float64(vt.ImageClicks), imageClickCap)},
+		{"pages", w.Pages, scale(float64(vt.NumPages), pageCap)},
+		{"individual_visits", w.IndividualVisits, scale(float64(vt.IndividualVisits), visitCap)},
+		{"clicks", w.Clicks, scale(float64(vt.NumClicks), clickCap)},
+		{"click_distance", w.ClickDistance, closeness(vt.AvgClickDistance, vt.NumClicks)},
+		{"recency", w.Recency, recency(vt.LastActionTime, now)},
+	}
+
+	res := models.OtfResult{
+		Threshold:     c.Threshold,
+		Contributions: make(map[string]float64),
+	}
+
+	total := 0.0
+	for _, s := range signals {
+		total += s.weight
+	}
+	if total <= 0 {
+		return res
+	}
+
+	for _, s := range signals {
+		contrib := s.weight * s.value / total
+		res.Contributions[s.name] = contrib
+		res.Score += contrib
+	}
+	res.Otf = res.Score >= c.Threshold
+	return res
+}
+
+/* scale maps v onto 0..1, saturating at max */
+func scale(v float64, max float64) float64 {
+	if v <= 0 {
+		return 0
+	}
+	return math.Min(v/max, 1)
+}
+
+/* closeness is 1 for clicks on top of each other and 0 for scattered ones */
+func closeness(distance float64, clicks int16) float64 {
+	if clicks < 2 {
+		return 0
+	}
+	return 1 - scale(distance, clickDistanceCap)
+}
+
+/* recency decays linearly from 1 for an action now to 0 at the end of the window */
+func recency(last time.Time, now time.Time) float64 {
+	if last.IsZero() {
+		return 0
+	}
+	return 1 - scale(now.Sub(last).Seconds(), recencyWindow)
+}
@@ -0,0 +1,137 @@
+package otf
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malalwan/slaash/internal/models"
+)
+
+/* only returns a config that scores a single signal */
+func only(threshold float64, set func(w *models.OtfWeights)) models.OtfConfig {
+	c := models.OtfConfig{Threshold: threshold}
+	set(&c.Weights)
+	return c
+}
+
+func scroll(w *models.OtfWeights)        { w.ScrollDepth = 1 }
+func addToCarts(w *models.OtfWeights)    { w.AddToCarts = 1 }
+func clickDistance(w *models.OtfWeights) { w.ClickDistance = 1 }
+func recent(w *models.OtfWeights)        { w.Recency = 1 }
+
+func TestScore(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		vt        models.VisitTable
+		config    models.OtfConfig
+		wantScore float64
+		wantOtf   bool
+	}{
+		{"empty visit", models.VisitTable{}, DefaultConfig(), 0, false},
+		{"empty visit at zero threshold", models.VisitTable{}, only(0, scroll), 0, true},
+		{"at threshold", models.VisitTable{MaxScrollDepth: 50}, only(0.5, scroll), 0.5, true},
+		{"below threshold", models.VisitTable{MaxScrollDepth: 49}, only(0.5, scroll), 0.49, false},
+		{"full score at threshold 1", models.VisitTable{MaxScrollDepth: 100}, only(1, scroll), 1, true},
+		{"saturated signal", models.VisitTable{AddToCarts: 10}, only(1, addToCarts), 1, true},
+		{"negative signal", models.VisitTable{AddToCarts: -2}, only(0, addToCarts), 0, true},
+		{"one click has no distance", models.VisitTable{NumClicks: 1}, only(0.5, clickDistance), 0, false},
+		{"clicks on one spot", models.VisitTable{NumClicks: 2}, only(0.5, clickDistance), 1, true},
+		{"scattered clicks", models.VisitTable{NumClicks: 5, AvgClickDistance: 1200}, only(0.5, clickDistance), 0, false},
+		{"no last action", models.VisitTable{}, only(0.5, recent), 0, false},
+		{"action now", models.VisitTable{LastActionTime: now}, only(0.5, recent), 1, true},
+		{"action half a window ago", models.VisitTable{LastActionTime: now.Add(-15 * time.Minute)}, only(0.5, recent), 0.5, true},
+		{"action before the window", models.VisitTable{LastActionTime: now.Add(-2 * time.Hour)}, only(0.5, recent), 0, false},
+		{
+			"weights are normalised",
+			models.VisitTable{MaxScrollDepth: 100},
+			models.OtfConfig{Threshold: 0.5, Weights: models.OtfWeights{ScrollDepth: 2, AddToCarts: 2}},
+			0.5, true,
+		},
+		{"all weights zero", models.VisitTable{MaxScrollDepth: 100, AddToCarts: 3}, models.OtfConfig{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Score(tt.vt, tt.config, now)
+			if math.Abs(got.Score-tt.wantScore) > 1e-9 {
+				t.Errorf("score = %v, want %v", got.Score, tt.wantScore)
+			}
+			if got.Otf != tt.wantOtf {
+				t.Errorf("otf = %v, want %v", got.Otf, tt.wantOtf)
+			}
+			if got.Threshold != tt.config.Threshold {
+				t.Errorf("threshold = %v, want %v", got.Threshold, tt.config.Threshold)
+			}
+		})
+	}
+}
+
+func TestScoreContributions(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	vt := models.VisitTable{
+		MaxScrollDepth:   80,
+		AddToCarts:       1,
+		ImageClicks:      4,
+		NumPages:         3,
+		IndividualVisits: 2,
+		NumClicks:        12,
+		AvgClickDistance: 200,
+		LastActionTime:   now.Add(-5 * time.Minute),
+	}
+
+	got := Score(vt, DefaultConfig(), now)
+	if len(got.Contributions) != 8 {
+		t.Errorf("got %d contributions, want 8: %v", len(got.Contributions), got.Contributions)
+	}
+	sum := 0.0
+	for name, c := range got.Contributions {
+		if c < 0 {
+			t.Errorf("%s contributes %v", name, c)
+		}
+		sum += c
+	}
+	if math.Abs(sum-got.Score) > 1e-9 {
+		t.Errorf("contributions sum to %v, score is %v", sum, got.Score)
+	}
+	if got.Score <= 0 || got.Score > 1 {
+		t.Errorf("score = %v, want within (0, 1]", got.Score)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  func(c *models.OtfConfig)
+		wantErr string
+	}{
+		{"default", func(c *models.OtfConfig) {}, ""},
+		{"zero threshold", func(c *models.OtfConfig) { c.Threshold = 0 }, ""},
+		{"threshold 1", func(c *models.OtfConfig) { c.Threshold = 1 }, ""},
+		{"negative threshold", func(c *models.OtfConfig) { c.Threshold = -0.1 }, "threshold"},
+		{"threshold above 1", func(c *models.OtfConfig) { c.Threshold = 1.1 }, "threshold"},
+		{"NaN threshold", func(c *models.OtfConfig) { c.Threshold = math.NaN() }, "threshold"},
+		{"negative weight", func(c *models.OtfConfig) { c.Weights.Pages = -0.1 }, "weight pages"},
+		{"NaN weight", func(c *models.OtfConfig) { c.Weights.Recency = math.NaN() }, "weight recency"},
+		{"infinite weight", func(c *models.OtfConfig) { c.Weights.Clicks = math.Inf(1) }, "weight clicks"},
+		{"all weights zero", func(c *models.OtfConfig) { c.Weights = models.OtfWeights{} }, "at least one weight"},
+		{"one positive weight", func(c *models.OtfConfig) { c.Weights = models.OtfWeights{ImageClicks: 0.1} }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.config(&c)
+			err := Validate(c)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("no error, want one about %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("error %q, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
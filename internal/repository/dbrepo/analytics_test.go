@@ -0,0 +1,200 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/malalwan/slaash/internal/migrate"
+	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/repository"
+)
+
+/*
+These tests go through repository.AnalyticsRepo, so both backends are held to
+the same answers. Postgres needs TEST_DATABASE_URL, clickhouse is tested too
+when TEST_CLICKHOUSE_URL is set and gets a copy of the postgres rows of the store.
+*/
+
+/* analyticsBackends returns the analytics repo of every backend that can be tested */
+func analyticsBackends(t *testing.T, pg *postgresDBRepo, store int) map[string]repository.AnalyticsRepo {
+	t.Helper()
+	backends := map[string]repository.AnalyticsRepo{"postgres": pg}
+
+	dsn := os.Getenv("TEST_CLICKHOUSE_URL")
+	if dsn == "" {
+		return backends
+	}
+	ch, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ch.Close() })
+
+	m, err := migrate.New("clickhouse", ch, "../../../migrations/clickhouse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	copyStoreToClickhouse(t, pg.DB, ch, store)
+	t.Cleanup(func() {
+		ch.Exec(`ALTER TABLE Visitor DELETE WHERE store = $1`, store)
+		ch.Exec(`ALTER TABLE Checkout DELETE WHERE store = $1`, store)
+	})
+
+	backends["clickhouse"] = &clickhouseAnalyticsRepo{
+		App:      pg.App,
+		DB:       ch,
+		Postgres: pg.DB,
+		cursors:  make(map[string]syncCursor),
+	}
+	return backends
+}
+
+/* copyStoreToClickhouse does what Sync does for one store, without waiting out its lag */
+func copyStoreToClickhouse(t *testing.T, pg *sql.DB, ch *sql.DB, store int) {
+	t.Helper()
+	copies := []struct {
+		selectStmt, insertStmt string
+		scan                   func(rows *sql.Rows) ([]interface{}, error)
+	}{
+		{
+			`SELECT id, store, anonymous_id, product_id, COALESCE(campaign_id, 0), timestamp,
+			 deal_shown, deal_clicked, code_shown, code_copied, COALESCE(discount_code, 0), changed_at
+			 FROM visitor WHERE store = $1`,
+			`INSERT INTO Visitor (id, store, anonymous_id, product_id, campaign_id, timestamp,
+			 deal_shown, deal_clicked, code_shown, code_copied, discount_code, changed_at)`,
+			func(rows *sql.Rows) ([]interface{}, error) {
+				var id, pid, dc int64
+				var store, cid int32
+				var aid string
+				var ts, ca time.Time
+				var ds, dk, cs, cc bool
+				err := rows.Scan(&id, &store, &aid, &pid, &cid, &ts, &ds, &dk, &cs, &cc, &dc, &ca)
+				return []interface{}{id, store, aid, pid, cid, ts, ds, dk, cs, cc, dc, ca}, err
+			},
+		},
+		{
+			`SELECT id, store, anonymous_id, order_id, COALESCE(line_item_id, 0), product_id,
+			 COALESCE(campaign_id, 0), gmv, discount_amount, COALESCE(discount_code, 0), timestamp, changed_at
+			 FROM checkout WHERE store = $1`,
+			`INSERT INTO Checkout (id, store, anonymous_id, order_id, line_item_id, product_id,
+			 campaign_id, gmv, discount_amount, discount_code, timestamp, changed_at)`,
+			func(rows *sql.Rows) ([]interface{}, error) {
+				var id, oid, lid, pid, gmv, disc, dc int64
+				var store, cid int32
+				var aid string
+				var ts, ca time.Time
+				err := rows.Scan(&id, &store, &aid, &oid, &lid, &pid, &cid, &gmv, &disc, &dc, &ts, &ca)
+				return []interface{}{id, store, aid, oid, lid, pid, cid, gmv, disc, dc, ts, ca}, err
+			},
+		},
+	}
+	for _, c := range copies {
+		rows, err := pg.Query(c.selectStmt, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := [][]interface{}{}
+		for rows.Next() {
+			values, err := c.scan(rows)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch = append(batch, values)
+		}
+		rows.Close()
+
+		tx, err := ch.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		insert, err := tx.Prepare(c.insertStmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, values := range batch {
+			if _, err = insert.Exec(values...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGetTopProducts(t *testing.T) {
+	pg := testPostgres(t)
+	store := testStore(t, pg)
+	ts := time.Date(2026, 10, 12, 10, 0, 0, 0, time.UTC)
+	base := time.Now().UnixNano()
+
+	/* product 16 sells best but is sixth by visitors, 13 to 15 never sold */
+	users := map[int64]int{11: 3, 12: 2, 13: 1, 14: 1, 15: 1, 16: 1}
+	for pid, n := range users {
+		for i := 0; i < n; i++ {
+			_, err := pg.InsertVisitor(models.Visitor{AnonymousID: "v", Store: store, ProductId: pid, Timestamp: ts})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := pg.InsertCheckouts([]models.Checkout{
+		{Store: store, OrderID: base, LineItemID: base, ProductID: 11, GMV: 100000, DiscountAmount: 10000, Timestamp: ts},
+		{Store: store, OrderID: base + 1, LineItemID: base + 1, ProductID: 11, GMV: 50000, DiscountAmount: 5000, Timestamp: ts},
+		{Store: store, OrderID: base + 1, LineItemID: base + 2, ProductID: 12, GMV: 30000, DiscountAmount: 3000, Timestamp: ts},
+		{Store: store, OrderID: base + 2, LineItemID: base + 3, ProductID: 16, GMV: 999900, DiscountAmount: 0, Timestamp: ts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantProds := []int64{11, 12, 13, 14, 15}
+	wantUsers := []int{3, 2, 1, 1, 1}
+	wantDiscounts := []int{15000, 3000, 0, 0, 0}
+	wantGmv := []int{150000, 30000, 0, 0, 0}
+
+	for name, repo := range analyticsBackends(t, pg, store) {
+		t.Run(name, func(t *testing.T) {
+			prods, users, discounts, gmv, err := repo.GetTopProducts(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(prods, wantProds) {
+				t.Errorf("products = %v, want %v", prods, wantProds)
+			}
+			if !reflect.DeepEqual(users, wantUsers) {
+				t.Errorf("users = %v, want %v", users, wantUsers)
+			}
+			if !reflect.DeepEqual(discounts, wantDiscounts) {
+				t.Errorf("discounts = %v, want %v", discounts, wantDiscounts)
+			}
+			if !reflect.DeepEqual(gmv, wantGmv) {
+				t.Errorf("gmv = %v, want %v", gmv, wantGmv)
+			}
+		})
+	}
+}
+
+func TestGetTopProductsEmpty(t *testing.T) {
+	pg := testPostgres(t)
+	store := testStore(t, pg)
+
+	for name, repo := range analyticsBackends(t, pg, store) {
+		t.Run(name, func(t *testing.T) {
+			prods, users, discounts, gmv, err := repo.GetTopProducts(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(prods) != 0 || len(users) != 0 || len(discounts) != 0 || len(gmv) != 0 {
+				t.Errorf("got %v %v %v %v for a store without visitors", prods, users, discounts, gmv)
+			}
+		})
+	}
+}
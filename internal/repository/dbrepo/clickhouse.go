@@ -2,33 +2,216 @@ package dbrepo
 
 import (
 	"context"
+	"encoding/json"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/malalwan/slaash/internal/models"
 )
 
+/*
+Clickstream holds posthog style events sorted by store and device_id, the
+$device_id property. properties is a JSON string, properties read here:
+$device_id (all), $session_id, $pathname, $referrer, $host ($pageview),
+selector, tag_name, src, x, y ($autocapture), depth ($scroll),
+product_id, quantity (add_to_cart)
+*/
+
 func (m *clickhouseDBRepo) AllUsers() {
 }
 
-func (m *clickhouseDBRepo) PullStreamByAnonymousID(id string) (models.VisitTable, error) {
+/* PullStreamByAnonymousID aggregates the clickstream of one device on one store into its visit table */
+func (m *clickhouseDBRepo) PullStreamByAnonymousID(store int, id string) (models.VisitTable, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `select
-				COUNT(event) FILTER (WHERE event = '$autocapture')
-			from Clickstream
-			where properties.$device_id = '$1'`
-	j := models.VisitTable{}
-	rows, err := m.DB.QueryContext(ctx, stmt, id)
+	j := models.VisitTable{
+		AnonymousID:  id,
+		ScrollMap:    make(map[int8]int16),
+		CartItemsOmw: make(map[string]int8),
+		Images:       make(map[string]int16),
+		Pages:        make(map[string]int16),
+		ClickMap:     make(map[string]int16),
+	}
+
+	/* one row of totals, click distance is averaged over consecutive clicks */
+	stmt1 := `SELECT clicks, pages, visits, carts, image_clicks, max_scroll,
+			  last_action, last_action_time, last_click_time, referrer, store_root,
+			  if(length(c) < 2, 0, arrayAvg(arrayMap(i -> sqrt(pow(c[i].2 - c[i - 1].2, 2) + pow(c[i].3 - c[i - 1].3, 2)),
+				arraySlice(arrayEnumerate(c), 2)))) AS avg_click_distance
+			  FROM (
+				SELECT
+				countIf(event = '$autocapture') AS clicks,
+				countIf(event = '$pageview') AS pages,
+				uniqExactIf(JSONExtractString(properties, '$session_id'), JSONExtractString(properties, '$session_id') != '') AS visits,
+				countIf(event = 'add_to_cart') AS carts,
+				countIf(event = '$autocapture' AND JSONExtractString(properties, 'tag_name') = 'img') AS image_clicks,
+				maxIf(JSONExtractInt(properties, 'depth'), event = '$scroll') AS max_scroll,
+				argMax(event, timestamp) AS last_action,
+				max(timestamp) AS last_action_time,
+				maxIf(timestamp, event = '$autocapture') AS last_click_time,
+				argMinIf(JSONExtractString(properties, '$referrer'), timestamp, event = '$pageview') AS referrer,
+				argMinIf(JSONExtractString(properties, '$host'), timestamp, event = '$pageview') AS store_root,
+				arraySort(groupArrayIf((timestamp, JSONExtractFloat(properties, 'x'), JSONExtractFloat(properties, 'y')),
+					event = '$autocapture')) AS c
+				FROM Clickstream
+				WHERE store = $1 AND device_id = $2
+			  )`
+
+	var clicks, pages, visits, carts, images uint64
+	var maxScroll int64
+	var lat, lct time.Time
+	err := m.DB.QueryRowContext(ctx, stmt1, store, id).Scan(&clicks, &pages, &visits, &carts, &images,
+		&maxScroll, &j.LastAction, &lat, &lct, &j.Referrer, &j.StoreRoot, &j.AvgClickDistance)
+	if err != nil {
+		return j, err
+	}
+	/* counts past the width of the visit table fields saturate instead of wrapping */
+	j.NumClicks = int16(min(clicks, math.MaxInt16))
+	j.NumPages = int16(min(pages, math.MaxInt16))
+	j.IndividualVisits = int8(min(visits, math.MaxInt8))
+	j.AddToCarts = int8(min(carts, math.MaxInt8))
+	j.ImageClicks = int32(min(images, math.MaxInt32))
+	j.MaxScrollDepth = clampInt8(maxScroll)
+	/* clickhouse returns the epoch when there were no matching events */
+	if lat.Unix() > 0 {
+		j.LastActionTime = lat
+	}
+	if lct.Unix() > 0 {
+		j.LastClickTime = lct
+	}
+
+	/* one row per (kind, key) for every map on the visit table */
+	stmt2 := `SELECT 'page' AS kind, JSONExtractString(properties, '$pathname') AS k, toInt64(count()) AS n
+			  FROM Clickstream
+			  WHERE store = $1 AND device_id = $2 AND event = '$pageview'
+			  GROUP BY k
+			  UNION ALL
+			  SELECT 'click' AS kind, JSONExtractString(properties, 'selector') AS k, toInt64(count()) AS n
+			  FROM Clickstream
+			  WHERE store = $1 AND device_id = $2 AND event = '$autocapture'
+			  GROUP BY k
+			  UNION ALL
+			  SELECT 'image' AS kind, JSONExtractString(properties, 'src') AS k, toInt64(count()) AS n
+			  FROM Clickstream
+			  WHERE store = $1 AND device_id = $2 AND event = '$autocapture'
+			  AND JSONExtractString(properties, 'tag_name') = 'img'
+			  GROUP BY k
+			  UNION ALL
+			  SELECT 'scroll' AS kind, toString(intDiv(JSONExtractInt(properties, 'depth'), 10) * 10) AS k, toInt64(count()) AS n
+			  FROM Clickstream
+			  WHERE store = $1 AND device_id = $2 AND event = '$scroll'
+			  GROUP BY k
+			  UNION ALL
+			  SELECT 'cart' AS kind, JSONExtractString(properties, 'product_id') AS k,
+			  toInt64(sum(greatest(JSONExtractInt(properties, 'quantity'), 1))) AS n
+			  FROM Clickstream
+			  WHERE store = $1 AND device_id = $2 AND event = 'add_to_cart'
+			  GROUP BY k`
+
+	rows, err := m.DB.QueryContext(ctx, stmt2, store, id)
 	if err != nil {
 		return j, err
 	}
 	defer rows.Close()
+
+	var favPage, favClick, favImage, vicinity int64
 	for rows.Next() {
-		err = rows.Scan(&j.NumClicks)
+		var kind, k string
+		var n int64
+		err = rows.Scan(&kind, &k, &n)
 		if err != nil {
 			return j, err
 		}
+		switch kind {
+		case "page":
+			j.Pages[k] = clampInt16(n)
+			if n > favPage {
+				favPage, j.FavPage = n, k
+			}
+		case "click":
+			j.ClickMap[k] = clampInt16(n)
+			if n > favClick {
+				favClick, j.FavClick = n, k
+			}
+		case "image":
+			j.Images[k] = clampInt16(n)
+			if n > favImage {
+				favImage, j.FavImage = n, k
+			}
+		case "scroll":
+			bucket, _ := strconv.Atoi(k)
+			j.ScrollMap[clampInt8(int64(bucket))] = clampInt16(n)
+			if n > vicinity {
+				vicinity, j.ScrollVicinity = n, clampInt8(int64(bucket))
+			}
+		case "cart":
+			j.CartItemsOmw[k] = clampInt8(n)
+		}
+	}
+	return j, rows.Err()
+}
+
+/* clampInt8 saturates n at the bounds of an int8 */
+func clampInt8(n int64) int8 {
+	return int8(max(min(n, math.MaxInt8), math.MinInt8))
+}
+
+/* clampInt16 saturates n at the bounds of an int16 */
+func clampInt16(n int64) int16 {
+	return int16(max(min(n, math.MaxInt16), math.MinInt16))
+}
+
+/* GetLastEventTime is a cheap check for new events since a cached verdict */
+func (m *clickhouseDBRepo) GetLastEventTime(store int, id string) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT max(timestamp)
+			 FROM Clickstream
+			 WHERE store = $1 AND device_id = $2`
+
+	var t time.Time
+	err := m.DB.QueryRowContext(ctx, stmt, store, id).Scan(&t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t.Unix() <= 0 {
+		return time.Time{}, nil
+	}
+	return t, nil
+}
+
+/* InsertClickstream writes a batch of events in one insert */
+func (m *clickhouseDBRepo) InsertClickstream(es []models.ClickEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO Clickstream (uuid, store, device_id, event, properties, timestamp)`)
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		props, err := json.Marshal(e.Properties)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, e.UUID, int32(e.Store), e.DeviceID, e.Event, string(props), e.Timestamp.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		m.App.ErrorLog.Println("Clickhouse insertion failed")
+		return err
 	}
-	return j, nil
+	return nil
 }
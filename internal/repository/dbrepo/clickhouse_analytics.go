@@ -0,0 +1,458 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/malalwan/slaash/internal/models"
+)
+
+/*
+The clickhouse analytics read the Visitor and Checkout copies that Sync keeps
+of the postgres rows. Copies are replaced when a row changes, so every read
+uses FINAL to see only the latest copy of each row.
+*/
+
+/* syncCursor is the last row of a table copied to clickhouse */
+type syncCursor struct {
+	changedAt time.Time
+	id        int64
+}
+
+/* GetCheckoutTotals returns the gmv, discount and conversions of the store's checkouts in [from, to) */
+func (m *clickhouseAnalyticsRepo) GetCheckoutTotals(id int, from time.Time, to time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT sum(gmv), sum(discount_amount), uniqExact(order_id)
+			 FROM Checkout FINAL
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3`
+
+	var gmv, disc, conv int64
+	err := m.DB.QueryRowContext(ctx, stmt, id, from.UTC(), to.UTC()).Scan(&gmv, &disc, &conv)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"gmv": int(gmv), "discount": int(disc), "conversions": int(conv)}, nil
+}
+
+/*
+GetVisitorTotals returns the users, distinct products, impressions and code
+copies of the store's visitors in [from, to)
+*/
+func (m *clickhouseAnalyticsRepo) GetVisitorTotals(id int, from time.Time, to time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT count(), uniqExact(product_id), countIf(deal_shown), countIf(code_copied)
+			 FROM Visitor FINAL
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3`
+
+	var users, products, impressions, copies int64
+	err := m.DB.QueryRowContext(ctx, stmt, id, from.UTC(), to.UTC()).Scan(&users, &products, &impressions, &copies)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"users": int(users), "products": int(products),
+		"impressions": int(impressions), "code_copies": int(copies)}, nil
+}
+
+/* GetSeriesDataFromCheckout returns the gmv and discount series of the query window */
+func (m *clickhouseAnalyticsRepo) GetSeriesDataFromCheckout(q models.AnalyticsQuery, id int) ([]map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	gmap := q.EmptySeries()
+	dmap := q.EmptySeries()
+
+	stmt := `SELECT ` + clickhouseBucket + ` AS interval, sum(gmv), sum(discount_amount)
+			 FROM Checkout FINAL
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3
+			 GROUP BY interval
+			 ORDER BY interval`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, clickhouseSeriesArgs(q, id)...)
+	if err != nil {
+		return []map[string]int{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t time.Time
+		var g, d int64
+		err = rows.Scan(&t, &g, &d)
+		if err != nil {
+			return []map[string]int{}, err
+		}
+		gmap[q.SeriesKey(t)] = int(g)
+		dmap[q.SeriesKey(t)] = int(d)
+	}
+
+	return []map[string]int{gmap, dmap}, rows.Err()
+}
+
+/* GetSeriesDataFromVisitor returns the users and products series of the query window */
+func (m *clickhouseAnalyticsRepo) GetSeriesDataFromVisitor(q models.AnalyticsQuery, id int) ([]map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	pmap := q.EmptySeries()
+	umap := q.EmptySeries()
+
+	stmt := `SELECT ` + clickhouseBucket + ` AS interval, count(), uniqExact(product_id)
+			 FROM Visitor FINAL
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3
+			 GROUP BY interval
+			 ORDER BY interval`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, clickhouseSeriesArgs(q, id)...)
+	if err != nil {
+		return []map[string]int{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t time.Time
+		var u, p int64
+		err = rows.Scan(&t, &u, &p)
+		if err != nil {
+			return []map[string]int{}, err
+		}
+		umap[q.SeriesKey(t)] = int(u)
+		pmap[q.SeriesKey(t)] = int(p)
+	}
+
+	return []map[string]int{umap, pmap}, rows.Err()
+}
+
+/* GetTopProducts returns the five products most visitors got a deal on, with their users, discount and gmv */
+func (m *clickhouseAnalyticsRepo) GetTopProducts(id int) ([]int64, []int, []int, []int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	prods := []int64{}
+	users := []int{}
+	discounts := []int{}
+	gmv := []int{}
+
+	stmt := `SELECT v.product_id, v.users, c.discount, c.gmv
+			 FROM (
+				SELECT product_id, count() AS users
+				FROM Visitor FINAL
+				WHERE store = $1
+				GROUP BY product_id
+				ORDER BY users DESC, product_id
+				LIMIT 5
+			 ) AS v
+			 LEFT JOIN (
+				SELECT product_id, sum(discount_amount) AS discount, sum(gmv) AS gmv
+				FROM Checkout FINAL
+				WHERE store = $1
+				GROUP BY product_id
+			 ) AS c ON c.product_id = v.product_id
+			 ORDER BY v.users DESC, v.product_id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, id)
+	if err != nil {
+		return prods, users, discounts, gmv, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p, u, d, g int64
+		err = rows.Scan(&p, &u, &d, &g)
+		if err != nil {
+			return prods, users, discounts, gmv, err
+		}
+		prods = append(prods, p)
+		users = append(users, int(u))
+		discounts = append(discounts, int(d))
+		gmv = append(gmv, int(g))
+	}
+
+	return prods, users, discounts, gmv, rows.Err()
+}
+
+/* GetAggOtfByDuration returns the series of OTF visitors of the query window */
+func (m *clickhouseAnalyticsRepo) GetAggOtfByDuration(q models.AnalyticsQuery, id int) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	otf := q.EmptySeries()
+
+	stmt := `SELECT ` + clickhouseBucket + ` AS interval, count()
+			 FROM Visitor FINAL
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3
+			 GROUP BY interval
+			 ORDER BY interval`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, clickhouseSeriesArgs(q, id)...)
+	if err != nil {
+		return map[string]int{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t time.Time
+		var u int64
+		err = rows.Scan(&t, &u)
+		if err != nil {
+			return map[string]int{}, err
+		}
+		otf[q.SeriesKey(t)] = int(u)
+	}
+
+	return otf, rows.Err()
+}
+
+/*
+GetAllCampaigns lists the store's campaigns from postgres, newest first. Closed
+campaigns carry their frozen metrics, the ones still running are computed here.
+*/
+func (m *clickhouseAnalyticsRepo) GetAllCampaigns(id int) ([]models.Campaign, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tz string
+	err := m.Postgres.QueryRowContext(ctx, `SELECT timezone FROM store WHERE id = $1`, id).Scan(&tz)
+	if err != nil {
+		return nil, err
+	}
+	loc := models.Store{Timezone: tz}.Location()
+
+	stmt := `SELECT id, starts_at, ends_at, status, default_discount, discount_category, max_discount,
+			 discount_value, gmv_value, users, products, aov, impressions, promo_copied,
+			 successful_redemptions, conversions
+			 FROM campaign
+			 WHERE store = $1
+			 ORDER BY starts_at DESC`
+
+	j := []models.Campaign{}
+	live := []int32{}
+	rows, err := m.Postgres.QueryContext(ctx, stmt, id)
+	if err != nil {
+		return j, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c models.Campaign
+		var dv, gv, aov sql.NullFloat64
+		var u, p, imp, pc, sr, conv sql.NullInt64
+		err = rows.Scan(&c.ID, &c.StartTime, &c.EndTime, &c.Status, &c.DefaultDiscount,
+			&c.DiscountCategory, &c.MaxDiscount, &dv, &gv, &u, &p, &aov, &imp, &pc, &sr, &conv)
+		if err != nil {
+			return j, err
+		}
+		if !imp.Valid {
+			live = append(live, int32(c.ID))
+		}
+		c.DiscountValue = float32(dv.Float64)
+		c.GmvValue = float32(gv.Float64)
+		c.Users = int(u.Int64)
+		c.Products = int(p.Int64)
+		c.Aov = float32(aov.Float64)
+		c.Impressions = imp.Int64
+		c.PromoCopied = pc.Int64
+		c.SuccessfulRedemptions = sr.Int64
+		c.Conversions = conv.Int64
+		c.StartTime = c.StartTime.In(loc)
+		c.EndTime = c.EndTime.In(loc)
+		j = append(j, c)
+	}
+	if err = rows.Err(); err != nil || len(live) == 0 {
+		return j, err
+	}
+
+	metrics, err := m.campaignMetrics(ctx, id, live)
+	if err != nil {
+		return j, err
+	}
+	for k := range j {
+		if mt, found := metrics[j[k].ID]; found {
+			j[k].DiscountValue = mt.DiscountValue
+			j[k].GmvValue = mt.GmvValue
+			j[k].Users = mt.Users
+			j[k].Products = mt.Products
+			j[k].Aov = mt.Aov
+			j[k].Impressions = mt.Impressions
+			j[k].PromoCopied = mt.PromoCopied
+			j[k].SuccessfulRedemptions = mt.SuccessfulRedemptions
+			j[k].Conversions = mt.Conversions
+		}
+	}
+	return j, nil
+}
+
+/* campaignMetrics computes the metrics of the given campaigns, like the postgres campaignMetrics */
+func (m *clickhouseAnalyticsRepo) campaignMetrics(ctx context.Context, id int, campaigns []int32) (map[int]models.Campaign, error) {
+	res := make(map[int]models.Campaign)
+
+	stmt1 := `SELECT campaign_id, uniqExact(anonymous_id), uniqExact(product_id),
+			  countIf(deal_shown), countIf(code_copied)
+			  FROM Visitor FINAL
+			  WHERE store = $1 AND has($2, campaign_id)
+			  GROUP BY campaign_id`
+
+	rows, err := m.DB.QueryContext(ctx, stmt1, id, campaigns)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid int32
+		var u, p, imp, pc int64
+		err = rows.Scan(&cid, &u, &p, &imp, &pc)
+		if err != nil {
+			return res, err
+		}
+		res[int(cid)] = models.Campaign{Users: int(u), Products: int(p), Impressions: imp, PromoCopied: pc}
+	}
+	if err = rows.Err(); err != nil {
+		return res, err
+	}
+
+	stmt2 := `SELECT campaign_id, sum(discount_amount), sum(gmv),
+			  uniqExact(discount_code), uniqExact(order_id)
+			  FROM Checkout FINAL
+			  WHERE store = $1 AND has($2, campaign_id)
+			  GROUP BY campaign_id`
+
+	rows2, err := m.DB.QueryContext(ctx, stmt2, id, campaigns)
+	if err != nil {
+		return res, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var cid int32
+		var d, g, sr, conv int64
+		err = rows2.Scan(&cid, &d, &g, &sr, &conv)
+		if err != nil {
+			return res, err
+		}
+		c := res[int(cid)]
+		c.DiscountValue = float32(d)
+		c.GmvValue = float32(g)
+		c.SuccessfulRedemptions = sr
+		c.Conversions = conv
+		if conv > 0 {
+			c.Aov = float32(g) / float32(conv)
+		}
+		res[int(cid)] = c
+	}
+	return res, rows2.Err()
+}
+
+/*
+clickhouseBucket is the start of a row's bucket in the store's zone, $4 is the
+granularity and $5 the zone
+*/
+const clickhouseBucket = `dateTrunc($4, timestamp, $5)`
+
+/* clickhouseSeriesArgs are the query args of a series statement using clickhouseBucket */
+func clickhouseSeriesArgs(q models.AnalyticsQuery, id int) []interface{} {
+	return []interface{}{id, q.From.UTC(), q.To.UTC(), q.Granularity, q.Location.String()}
+}
+
+/*
+Sync copies up to limit changed visitor and checkout rows each from postgres to
+clickhouse and returns how many it copied. Rows are taken in changed_at order
+and the cursor only moves once clickhouse has them, so a failed pass is simply
+retried. Rows changed in the last 30 seconds wait for the next pass, their
+transaction may still be committing behind rows already copied. Only one goroutine may call it, copying a row twice is harmless.
+*/
+func (m *clickhouseAnalyticsRepo) Sync(limit int) (int, error) {
+	v, err := m.syncTable("Visitor", limit,
+		`SELECT id, store, anonymous_id, product_id, COALESCE(campaign_id, 0), timestamp,
+		 COALESCE(deal_shown, false), COALESCE(deal_clicked, false), COALESCE(code_shown, false),
+		 COALESCE(code_copied, false), COALESCE(discount_code, 0), changed_at
+		 FROM visitor`,
+		`INSERT INTO Visitor (id, store, anonymous_id, product_id, campaign_id, timestamp,
+		 deal_shown, deal_clicked, code_shown, code_copied, discount_code, changed_at)`,
+		func(rows *sql.Rows) ([]interface{}, error) {
+			var id, pid, dc int64
+			var store, cid int32
+			var aid string
+			var ts, ca time.Time
+			var ds, dk, cs, cc bool
+			err := rows.Scan(&id, &store, &aid, &pid, &cid, &ts, &ds, &dk, &cs, &cc, &dc, &ca)
+			return []interface{}{id, store, aid, pid, cid, ts, ds, dk, cs, cc, dc, ca}, err
+		})
+	if err != nil {
+		return v, err
+	}
+
+	c, err := m.syncTable("Checkout", limit,
+		`SELECT id, store, COALESCE(anonymous_id, ''), order_id, COALESCE(line_item_id, 0), product_id,
+		 COALESCE(campaign_id, 0), gmv, discount_amount, COALESCE(discount_code, 0), timestamp, changed_at
+		 FROM checkout`,
+		`INSERT INTO Checkout (id, store, anonymous_id, order_id, line_item_id, product_id,
+		 campaign_id, gmv, discount_amount, discount_code, timestamp, changed_at)`,
+		func(rows *sql.Rows) ([]interface{}, error) {
+			var id, oid, lid, pid, gmv, disc, dc int64
+			var store, cid int32
+			var aid string
+			var ts, ca time.Time
+			err := rows.Scan(&id, &store, &aid, &oid, &lid, &pid, &cid, &gmv, &disc, &dc, &ts, &ca)
+			return []interface{}{id, store, aid, oid, lid, pid, cid, gmv, disc, dc, ts, ca}, err
+		})
+	return v + c, err
+}
+
+/*
+syncTable copies the next rows of one table. selectStmt must start with id and
+end with changed_at, scan returns the values to insert in the same order.
+*/
+func (m *clickhouseAnalyticsRepo) syncTable(table string, limit int, selectStmt string, insertStmt string,
+	scan func(rows *sql.Rows) ([]interface{}, error)) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cur, found := m.cursors[table]
+	if !found {
+		/* start from the last row clickhouse has, the epoch when it has none */
+		err := m.DB.QueryRowContext(ctx, `SELECT max(changed_at), argMax(id, changed_at) FROM `+table).
+			Scan(&cur.changedAt, &cur.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	stmt := selectStmt + `
+			 WHERE (changed_at, id) > ($1, $2)
+			 AND changed_at < (now() AT TIME ZONE 'UTC') - interval '30 seconds'
+			 ORDER BY changed_at, id
+			 LIMIT $3`
+	rows, err := m.Postgres.QueryContext(ctx, stmt, cur.changedAt.UTC(), cur.id, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	batch := [][]interface{}{}
+	for rows.Next() {
+		values, err := scan(rows)
+		if err != nil {
+			return 0, err
+		}
+		batch = append(batch, values)
+	}
+	if err = rows.Err(); err != nil || len(batch) == 0 {
+		return 0, err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.PrepareContext(ctx, insertStmt)
+	if err != nil {
+		return 0, err
+	}
+	for _, values := range batch {
+		if _, err = insert.ExecContext(ctx, values...); err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		m.App.ErrorLog.Println("Clickhouse insertion failed")
+		return 0, err
+	}
+
+	last := batch[len(batch)-1]
+	m.cursors[table] = syncCursor{changedAt: last[len(last)-1].(time.Time), id: last[0].(int64)}
+	return len(batch), nil
+}
@@ -17,6 +17,14 @@ type clickhouseDBRepo struct {
 	DB  *sql.DB
 }
 
+/* clickhouseAnalyticsRepo reads campaigns from postgres and everything else from clickhouse */
+type clickhouseAnalyticsRepo struct {
+	App      *config.AppConfig
+	DB       *sql.DB
+	Postgres *sql.DB
+	cursors  map[string]syncCursor
+}
+
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
 	return &postgresDBRepo{
 		App: a,
@@ -30,3 +38,19 @@ func NewClickhouseRepo(conn *sql.DB, a *config.AppConfig) repository.ClickhouseR
 		DB:  conn,
 	}
 }
+
+// NewAnalyticsRepo creates the analytics repo of the backend named in config, postgres by default
+func NewAnalyticsRepo(conn *sql.DB, clickhouse *sql.DB, a *config.AppConfig) repository.AnalyticsRepo {
+	if a.AnalyticsBackend == "clickhouse" {
+		return &clickhouseAnalyticsRepo{
+			App:      a,
+			DB:       clickhouse,
+			Postgres: conn,
+			cursors:  make(map[string]syncCursor),
+		}
+	}
+	return &postgresDBRepo{
+		App: a,
+		DB:  conn,
+	}
+}
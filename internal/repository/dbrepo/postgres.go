@@ -2,11 +2,16 @@ package dbrepo
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
-	"strconv"
+	"encoding/json"
+	"fmt"
 	"time"
 
+	goshopify "github.com/bold-commerce/go-shopify/v3"
+	"github.com/malalwan/slaash/internal/helpers"
 	"github.com/malalwan/slaash/internal/models"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func (m *postgresDBRepo) ToggleDealList(id int, t bool) error {
@@ -29,8 +34,9 @@ func (m *postgresDBRepo) SetTurnOffTime(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	/* the scheduler skips the next campaign and clears the flag */
 	stmt := `UPDATE store
-			 SET campaign_turn_off_time = $1
+			 SET campaign_turn_off_time = $1, skip_next_campaign = true
 			 WHERE id = $2`
 
 	m.App.InfoLog.Println(time.Now().Format("15:04:05"))
@@ -43,6 +49,37 @@ func (m *postgresDBRepo) SetTurnOffTime(id int) error {
 	return nil
 }
 
+const passwordCost = 12 // bcrypt work factor, hashes from a lower cost are redone on login
+
+/* dummyHash is compared against when the email is unknown, so the answer takes as long */
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("slaash"), passwordCost)
+
+/* hashPassword is how dashboard passwords are stored */
+func hashPassword(pass string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), passwordCost)
+	return string(hash), err
+}
+
+/*
+checkPassword compares pass with a stored password. Rows from before hashing
+hold the plain text, stale is set for them and for hashes of a lower cost.
+*/
+func checkPassword(stored string, pass string) (ok bool, stale bool) {
+	if stored == "" {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	if err != nil {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1, true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)) == nil, cost < passwordCost
+}
+
+/*
+FetchUserByCreds returns the user when the password matches, found is false
+otherwise. A plain text or weakly hashed password is rehashed on the way, and
+the returned user never carries the password.
+*/
 func (m *postgresDBRepo) FetchUserByCreds(email string, pass string) (models.Users, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -50,11 +87,12 @@ func (m *postgresDBRepo) FetchUserByCreds(email string, pass string) (models.Use
 	var u models.Users
 	found := false
 
-	stmt := `SELECT *
+	stmt := `SELECT first_name, last_name, email, password, access_level,
+			 created_at, updated_at, store, photo, misc
 			 FROM users
-			 WHERE email = $1 AND password = $2`
+			 WHERE email = $1`
 
-	rows, err := m.DB.QueryContext(ctx, stmt, email, pass)
+	rows, err := m.DB.QueryContext(ctx, stmt, email)
 	if err != nil {
 		m.App.ErrorLog.Println("DB extraction failed")
 		return u, found, err
@@ -85,317 +123,120 @@ func (m *postgresDBRepo) FetchUserByCreds(email string, pass string) (models.Use
 			u.Misc = msc.String
 		}
 	}
-	return u, found, nil
-}
-
-func (m *postgresDBRepo) GetCampignEndTime(id int) (time.Time, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	stmt := `SELECT campaign_renewal_time
-			 FROM store
-			 WHERE id = $1`
-
-	rows, err := m.DB.QueryContext(ctx, stmt, id)
-	if err != nil {
-		m.App.ErrorLog.Println("DB extraction failed")
-		return time.Now(), err
-	}
-	defer rows.Close()
-	var s string
-	var t time.Time
-	for rows.Next() {
-		err := rows.Scan(&s)
-		if err != nil {
-			m.App.ErrorLog.Panicln("Assignment of extracted value from DB failed")
-			return time.Now(), err
-		}
-
-		h, _ := strconv.Atoi(s[:2])
-		m, _ := strconv.Atoi(s[3:5])
-		s, _ := strconv.Atoi(s[6:])
-		ct := time.Now()
-		ch, cm, cs := ct.Clock()
-		after := false
-		if h > ch {
-			after = true
-		} else if h == ch {
-			if m > cm {
-				after = true
-			} else if m == cm {
-				if s > cs {
-					after = true
-				} else if s == cs {
-					after = true
-				}
-			}
-		}
-
-		if after {
-			t = time.Date(ct.Year(), ct.Month(), ct.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
-		} else {
-			t = time.Date(ct.Year(), ct.Month(), ct.Day()+1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
-		}
+	if err = rows.Err(); err != nil {
+		return models.Users{}, false, err
 	}
 
-	// push t to db again
-	return t, nil
-}
-
-func (m *postgresDBRepo) GetAggFromCheckout(id int) (map[string][]int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	mp := make(map[string][]int)
-
-	stmt1 := `SELECT SUM(gmv), SUM(discount_amount)
-			  FROM checkout
-			  WHERE timestamp > $1 AND store = $2`
-
-	stmt2 := `SELECT SUM(gmv), SUM(discount_amount)
-			  FROM checkout
-			  WHERE timestamp < $1 AND timestamp > $2 AND store = $3`
-
-	t, err := m.GetCampignEndTime(id)
-	if err != nil {
-		return mp, err
+	if !found {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return u, false, nil
 	}
-
-	rows1, err := m.DB.QueryContext(ctx, stmt1, t, id)
-	if err != nil {
-		return mp, err
+	ok, stale := checkPassword(u.Password, pass)
+	if !ok {
+		return models.Users{}, false, nil
 	}
-	defer rows1.Close()
-
-	var gmv, disc sql.NullInt64
-	for rows1.Next() {
-		err = rows1.Scan(&gmv, &disc)
-		if err != nil {
-			return mp, err
+	if stale {
+		/* only if nobody changed it meanwhile, a failed upgrade is retried on the next login */
+		hash, err := hashPassword(pass)
+		if err == nil {
+			_, err = m.DB.ExecContext(ctx, `UPDATE users SET password = $2 WHERE email = $1 AND password = $3`,
+				email, hash, u.Password)
 		}
-	}
-
-	mp["gmv"] = []int{}
-	mp["discount"] = []int{}
-
-	if gmv.Valid && disc.Valid {
-		mp["gmv"] = append(mp["gmv"], int(gmv.Int64))
-		mp["discount"] = append(mp["discount"], int(disc.Int64))
-	} else {
-		mp["gmv"] = append(mp["gmv"], 0)
-		mp["discount"] = append(mp["discount"], 0)
-	}
-
-	rows2, err := m.DB.QueryContext(ctx, stmt2, t, t.AddDate(0, 0, -1), id)
-	if err != nil {
-		return mp, err
-	}
-	defer rows2.Close()
-
-	for rows1.Next() {
-		err = rows1.Scan(&gmv, &disc)
 		if err != nil {
-			return mp, err
+			m.App.ErrorLog.Println("Failed to rehash the password of", email, err)
 		}
 	}
-
-	if gmv.Valid && disc.Valid {
-		mp["gmv"] = append(mp["gmv"], int(gmv.Int64))
-		mp["discount"] = append(mp["discount"], int(disc.Int64))
-	} else {
-		mp["gmv"] = append(mp["gmv"], 0)
-		mp["discount"] = append(mp["discount"], 0)
-	}
-
-	return mp, nil
+	u.Password = ""
+	return u, true, nil
 }
 
-func (m *postgresDBRepo) GetAggFromVisitor(id int) (map[string][]int, error) {
+/* UpdatePassword hashes and stores a new dashboard password */
+func (m *postgresDBRepo) UpdatePassword(email string, pass string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	mp := make(map[string][]int)
-
-	stmt1 := `SELECT COUNT(anonymous_id), COUNT(DISTINCT product_id)
-			  FROM visitor
-			  WHERE timestamp > $1 AND store = $2`
-
-	stmt2 := `SELECT COUNT(anonymous_id), COUNT(DISTINCT product_id)
-			  FROM visitor
-			  WHERE timestamp < $1 AND timestamp > $2 AND store = $3`
-
-	t, err := m.GetCampignEndTime(id)
+	hash, err := hashPassword(pass)
 	if err != nil {
-		return mp, err
+		return err
 	}
 
-	rows1, err := m.DB.QueryContext(ctx, stmt1, t, id)
+	stmt := `UPDATE users
+			 SET password = $2, updated_at = $3
+			 WHERE email = $1`
+
+	res, err := m.DB.ExecContext(ctx, stmt, email, hash, time.Now().UTC())
 	if err != nil {
-		return mp, err
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
 	}
-	defer rows1.Close()
-
-	var users, products int
-	for rows1.Next() {
-		err = rows1.Scan(&users, &products)
-		if err != nil {
-			return mp, err
-		}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no user %s", email)
 	}
+	return nil
+}
 
-	mp["users"] = []int{}
-	mp["products"] = []int{}
-	mp["users"] = append(mp["users"], users)
-	mp["products"] = append(mp["products"], products)
-
-	rows2, err := m.DB.QueryContext(ctx, stmt2, t, t.AddDate(0, 0, -1), id)
+/* GetCampignEndTime returns when the running campaign ends, in the store's timezone */
+func (m *postgresDBRepo) GetCampignEndTime(id int) (time.Time, error) {
+	store, err := m.GetStoreByID(id)
 	if err != nil {
-		return mp, err
-	}
-	defer rows2.Close()
-
-	for rows1.Next() {
-		err = rows1.Scan(&users, &products)
-		if err != nil {
-			return mp, err
-		}
+		m.App.ErrorLog.Println("DB extraction failed")
+		return time.Now(), err
 	}
-
-	mp["users"] = append(mp["users"], users)
-	mp["products"] = append(mp["products"], products)
-
-	return mp, nil
+	return store.CampaignStart(time.Now()).AddDate(0, 0, 1), nil
 }
 
-func (m *postgresDBRepo) GetDealDataFromCheckout(t1 time.Time, t2 time.Time, id int) (map[string][]int, error) {
+/* GetCheckoutTotals returns the gmv, discount and conversions of the store's checkouts in [from, to) */
+func (m *postgresDBRepo) GetCheckoutTotals(id int, from time.Time, to time.Time) (map[string]int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	mp := make(map[string][]int)
-
-	stmt1 := `SELECT SUM(gmv), SUM(discount_amount)
-			  FROM checkout
-			  WHERE timestamp > $1 AND store = $2`
-
-	stmt2 := `SELECT COUNT(anonymous_id), COUNT(DISTINCT product_id)
-			  FROM visitor
-			  WHERE timestamp < $1 AND timestamp > $2 AND store = $3`
-
-	rows1, err := m.DB.QueryContext(ctx, stmt1, t1, id)
-	if err != nil {
-		return mp, err
-	}
-	defer rows1.Close()
-
-	var gmv, disc sql.NullInt64
-	for rows1.Next() {
-		err = rows1.Scan(&gmv, &disc)
-		if err != nil {
-			return mp, err
-		}
-	}
-
-	mp["gmv"] = []int{}
-	mp["discount"] = []int{}
-	if gmv.Valid && disc.Valid {
-		mp["gmv"] = append(mp["gmv"], int(gmv.Int64))
-		mp["discount"] = append(mp["discount"], int(disc.Int64))
-	} else {
-		mp["gmv"] = append(mp["gmv"], 0)
-		mp["discount"] = append(mp["discount"], 0)
-	}
+	stmt := `SELECT COALESCE(SUM(gmv), 0), COALESCE(SUM(discount), 0), COALESCE(SUM(conversions), 0)
+			 FROM (` + checkoutHours + `) h`
 
-	rows2, err := m.DB.QueryContext(ctx, stmt2, t1, t2, id)
+	var gmv, disc, conv int64
+	err := m.DB.QueryRowContext(ctx, stmt, rollupArgs(id, from, to)...).Scan(&gmv, &disc, &conv)
 	if err != nil {
-		return mp, err
-	}
-	defer rows2.Close()
-
-	for rows1.Next() {
-		err = rows1.Scan(&gmv, &disc)
-		if err != nil {
-			return mp, err
-		}
-	}
-
-	if gmv.Valid && disc.Valid {
-		mp["gmv"] = append(mp["gmv"], int(gmv.Int64))
-		mp["discount"] = append(mp["discount"], int(disc.Int64))
-	} else {
-		mp["gmv"] = append(mp["gmv"], 0)
-		mp["discount"] = append(mp["discount"], 0)
+		return nil, err
 	}
-
-	return mp, nil
+	return map[string]int{"gmv": int(gmv), "discount": int(disc), "conversions": int(conv)}, nil
 }
 
-func (m *postgresDBRepo) GetDealDataFromVisitor(t1 time.Time, t2 time.Time, id int) (map[string][]int, error) {
+/*
+GetVisitorTotals returns the users, distinct products, impressions and code
+copies of the store's visitors in [from, to)
+*/
+func (m *postgresDBRepo) GetVisitorTotals(id int, from time.Time, to time.Time) (map[string]int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	mp := make(map[string][]int)
-
-	stmt1 := `SELECT COUNT(anonymous_id), COUNT(DISTINCT product_id)
-			  FROM visitor
-			  WHERE timestamp > $1 AND store = $2`
+	stmt := `WITH h AS (` + visitorHours + `)
+			 SELECT COALESCE(SUM(users), 0), COALESCE(SUM(impressions), 0), COALESCE(SUM(code_copies), 0),
+			 (SELECT COUNT(DISTINCT pid) FROM h, unnest(h.product_ids) pid)
+			 FROM h`
 
-	stmt2 := `SELECT COUNT(anonymous_id), COUNT(DISTINCT product_id)
-			  FROM visitor
-			  WHERE timestamp < $1 AND timestamp > $2 AND store = $3`
-
-	rows1, err := m.DB.QueryContext(ctx, stmt1, t1, id)
-	if err != nil {
-		return mp, err
-	}
-	defer rows1.Close()
-
-	var users, products int
-	for rows1.Next() {
-		err = rows1.Scan(&users, &products)
-		if err != nil {
-			return mp, err
-		}
-	}
-
-	mp["users"] = []int{}
-	mp["products"] = []int{}
-	mp["users"] = append(mp["users"], users)
-	mp["products"] = append(mp["products"], products)
-
-	rows2, err := m.DB.QueryContext(ctx, stmt2, t1, t2, id)
+	var users, impressions, copies, products int64
+	err := m.DB.QueryRowContext(ctx, stmt, rollupArgs(id, from, to)...).Scan(&users, &impressions, &copies, &products)
 	if err != nil {
-		return mp, err
-	}
-	defer rows2.Close()
-
-	for rows1.Next() {
-		err = rows1.Scan(&users, &products)
-		if err != nil {
-			return mp, err
-		}
+		return nil, err
 	}
-
-	mp["users"] = append(mp["users"], users)
-	mp["products"] = append(mp["products"], products)
-
-	return mp, nil
+	return map[string]int{"users": int(users), "products": int(products),
+		"impressions": int(impressions), "code_copies": int(copies)}, nil
 }
 
-func (m *postgresDBRepo) GetSeriesDataFromCheckout(t time.Time, id int) ([]map[string]int, error) {
+/* GetSeriesDataFromCheckout returns the gmv and discount series of the query window */
+func (m *postgresDBRepo) GetSeriesDataFromCheckout(q models.AnalyticsQuery, id int) ([]map[string]int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	gmap := make(map[string]int)
-	dmap := make(map[string]int)
+	gmap := q.EmptySeries()
+	dmap := q.EmptySeries()
 
-	stmt := `SELECT DATE_TRUNC('hour', timestamp) AS interval,
-			 COALESCE(SUM(gmv),0), COALESCE(SUM(discount_amount),0)
-			 FROM checkout
-		     WHERE store = $1
-			 AND timestamp >= $2
+	stmt := `SELECT ` + seriesBucket + ` AS interval,
+			 COALESCE(SUM(gmv),0), COALESCE(SUM(discount),0)
+			 FROM (` + checkoutHours + `) h
 			 GROUP BY interval
 			 ORDER BY interval;`
 
-	rows, err := m.DB.QueryContext(ctx, stmt, id, t)
+	rows, err := m.DB.QueryContext(ctx, stmt, seriesArgs(q, id)...)
 	if err != nil {
 		return []map[string]int{}, err
 	}
@@ -407,26 +248,34 @@ func (m *postgresDBRepo) GetSeriesDataFromCheckout(t time.Time, id int) ([]map[s
 		if err != nil {
 			return []map[string]int{}, err
 		}
-		gmap[t.Format("2006-01-02 15:04:05")] = int(g.Int64)
-		dmap[t.Format("2006-01-02 15:04:05")] = int(d.Int64)
+		gmap[q.SeriesKey(t)] = int(g.Int64)
+		dmap[q.SeriesKey(t)] = int(d.Int64)
 	}
 
-	return []map[string]int{gmap, dmap}, nil
+	return []map[string]int{gmap, dmap}, rows.Err()
 }
 
-func (m *postgresDBRepo) GetSeriesDataFromVisitor(t time.Time, id int) ([]map[string]int, error) {
+/* GetSeriesDataFromVisitor returns the users and products series of the query window */
+func (m *postgresDBRepo) GetSeriesDataFromVisitor(q models.AnalyticsQuery, id int) ([]map[string]int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	pmap := make(map[string]int)
-	umap := make(map[string]int)
-	stmt := `SELECT DATE_TRUNC('hour', timestamp) AS interval,
-			 COALESCE(COUNT(anonymous_id), 0) ,COALESCE(COUNT(DISTINCT product_id),0)
-			 FROM visitor
-			 WHERE store = $1
-			 AND timestamp >= $2
-			 GROUP BY interval
-			 ORDER BY interval;`
-	rows, err := m.DB.QueryContext(ctx, stmt, id, t)
+	pmap := q.EmptySeries()
+	umap := q.EmptySeries()
+
+	/* products are distinct over the whole bucket, so they are counted apart from the summed users */
+	stmt := `WITH b AS (
+				SELECT ` + seriesBucket + ` AS interval, users, product_ids
+				FROM (` + visitorHours + `) h
+			 )
+			 SELECT u.interval, u.users, COALESCE(p.products, 0)
+			 FROM (SELECT interval, SUM(users) AS users FROM b GROUP BY interval) u
+			 LEFT JOIN (
+				SELECT interval, COUNT(DISTINCT pid) AS products
+				FROM b, unnest(b.product_ids) pid
+				GROUP BY interval
+			 ) p ON p.interval = u.interval
+			 ORDER BY u.interval;`
+	rows, err := m.DB.QueryContext(ctx, stmt, seriesArgs(q, id)...)
 	if err != nil {
 		return []map[string]int{}, err
 	}
@@ -438,13 +287,14 @@ func (m *postgresDBRepo) GetSeriesDataFromVisitor(t time.Time, id int) ([]map[st
 		if err != nil {
 			return []map[string]int{}, err
 		}
-		umap[t.Format("2006-01-02 15:04:05")] = int(u.Int64)
-		pmap[t.Format("2006-01-02 15:04:05")] = int(p.Int64)
+		umap[q.SeriesKey(t)] = int(u.Int64)
+		pmap[q.SeriesKey(t)] = int(p.Int64)
 	}
 
-	return []map[string]int{umap, pmap}, nil
+	return []map[string]int{umap, pmap}, rows.Err()
 }
 
+/* GetTopProducts returns the five products most visitors got a deal on, with their users, discount and gmv */
 func (m *postgresDBRepo) GetTopProducts(id int) ([]int64, []int, []int, []int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -453,98 +303,56 @@ func (m *postgresDBRepo) GetTopProducts(id int) ([]int64, []int, []int, []int, e
 	discounts := []int{}
 	gmv := []int{}
 
-	stmt1 := `SELECT COUNT(anonymous_id) as users, product_id
-			 FROM visitor 
-			 WHERE store = $1
-			 GROUP BY product_id 
-			 ORDER BY users desc limit 5`
+	/* products without checkouts still rank, with no discount or gmv */
+	stmt := `SELECT v.product_id, v.users, COALESCE(c.discount, 0), COALESCE(c.gmv, 0)
+			 FROM (
+				SELECT product_id, COUNT(anonymous_id) AS users
+				FROM visitor
+				WHERE store = $1
+				GROUP BY product_id
+				ORDER BY users DESC, product_id
+				LIMIT 5
+			 ) AS v
+			 LEFT JOIN (
+				SELECT product_id, SUM(discount_amount) AS discount, SUM(gmv) AS gmv
+				FROM checkout
+				WHERE store = $1
+				GROUP BY product_id
+			 ) AS c ON c.product_id = v.product_id
+			 ORDER BY v.users DESC, v.product_id`
 
-	rows, err := m.DB.QueryContext(ctx, stmt1, id)
+	rows, err := m.DB.QueryContext(ctx, stmt, id)
 	if err != nil {
+		m.App.ErrorLog.Println("DB extraction failed")
 		return prods, users, discounts, gmv, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var p, u sql.NullInt64
-
-		err = rows.Scan(&u, &p)
-		if !p.Valid || err != nil {
-			return prods, users, discounts, gmv, err
-		}
-		prods = append(prods, p.Int64)
-		users = append(users, int(u.Int64))
-	}
-
-	stmt2 := ``
-	var rows2 *sql.Rows
-	if len(prods) == 0 {
-		m.App.InfoLog.Println("No products in the list")
-		return prods, users, discounts, gmv, err
-	} else if len(prods) < 5 && len(prods) >= 1 {
-		/* There are less than 5 products, so just diplay the top 1 */
-		stmt2 = `SELECT SUM(gmv), SUM(discount_amount)
-			  	 FROM checkout
-			  	 WHERE store = $1 and product_id = $2`
-		rows2, err = m.DB.QueryContext(ctx, stmt2, id, prods[0])
-		if err != nil {
-			return prods, users, discounts, gmv, err
-		}
-		defer rows2.Close()
-	} else {
-		stmt2 = `SELECT product_id, SUM(gmv) AS total_gmv, SUM(discount_amount) AS total_discount
-				 FROM (
-				 	SELECT
-				 		product_id,
-						gmv,
-						discount_amount,
-						CASE
-							WHEN product_id = $2 THEN 1
-							WHEN product_id = $3 THEN 2
-							WHEN product_id = $4 THEN 3
-							WHEN product_id = $5 THEN 4
-							WHEN product_id = $6 THEN 5
-							ELSE 6  -- This is to handle other product_ids not in the IN clause
-						END AS sort_order
-					FROM checkout
-					WHERE store = $1 and product_id IN ($2, $3, $4, $5, $6)
-				 ) AS subquery
-				 GROUP BY product_id, sort_order
-				 ORDER BY sort_order`
-
-		rows2, err = m.DB.QueryContext(ctx, stmt2, id,
-			prods[0], prods[1], prods[2], prods[3], prods[4])
+		var p, u, d, g int64
+		err = rows.Scan(&p, &u, &d, &g)
 		if err != nil {
 			return prods, users, discounts, gmv, err
 		}
-		defer rows2.Close()
-	}
-
-	for rows2.Next() {
-		var p, g, d, s sql.NullInt64
-
-		err = rows.Scan(&p, &g, &d, &s)
-		if !g.Valid || err != nil {
-			return prods, users, discounts, gmv, err
-		}
-		gmv = append(gmv, int(g.Int64))
-		discounts = append(discounts, int(d.Int64))
+		prods = append(prods, p)
+		users = append(users, int(u))
+		discounts = append(discounts, int(d))
+		gmv = append(gmv, int(g))
 	}
 
-	return prods, users, discounts, gmv, nil
+	return prods, users, discounts, gmv, rows.Err()
 }
 
-func (m *postgresDBRepo) GetAggOtfByDuration(t time.Time, id int) (map[string]int, error) {
+/* GetAggOtfByDuration returns the series of OTF visitors of the query window */
+func (m *postgresDBRepo) GetAggOtfByDuration(q models.AnalyticsQuery, id int) (map[string]int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	otf := make(map[string]int)
-	stmt := `SELECT DATE_TRUNC('hour', timestamp) AS interval,
-			 COALESCE(COUNT(anonymous_id), 0)
-			 FROM visitor
-			 WHERE store = $1
-			 AND timestamp >= $2
+	otf := q.EmptySeries()
+	stmt := `SELECT ` + seriesBucket + ` AS interval,
+			 COALESCE(SUM(users), 0)
+			 FROM (` + visitorHours + `) h
 			 GROUP BY interval
 			 ORDER BY interval`
-	rows, err := m.DB.QueryContext(ctx, stmt, id, t)
+	rows, err := m.DB.QueryContext(ctx, stmt, seriesArgs(q, id)...)
 	if err != nil {
 		return map[string]int{}, err
 	}
@@ -556,55 +364,242 @@ func (m *postgresDBRepo) GetAggOtfByDuration(t time.Time, id int) (map[string]in
 		if err != nil {
 			return map[string]int{}, err
 		}
-		otf[t.Format("2006-01-02 15:04:05")] = int(u.Int64)
+		otf[q.SeriesKey(t)] = int(u.Int64)
+	}
+
+	return otf, rows.Err()
+}
+
+/*
+checkoutHours and visitorHours give the store's ($1) metrics in [$2, $3) per
+UTC hour. Whole hours in [$4, $5) come from hourly_rollup, the partial hours at
+the edges of the window are read from the raw rows, so any window is exact.
+The raw part yields one row per checkout or visitor, never more than two hours.
+*/
+const checkoutHours = `SELECT hour, gmv, discount, conversions
+			 FROM hourly_rollup
+			 WHERE store = $1 AND hour >= $4 AND hour < $5
+			 UNION ALL
+			 SELECT date_trunc('hour', timestamp), gmv, discount_amount,
+			 CASE WHEN ROW_NUMBER() OVER (PARTITION BY order_id) = 1 THEN 1 ELSE 0 END
+			 FROM checkout
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3
+			 AND (timestamp < $4 OR timestamp >= $5)`
+
+const visitorHours = `SELECT hour, users, product_ids, impressions, code_copies
+			 FROM hourly_rollup
+			 WHERE store = $1 AND hour >= $4 AND hour < $5
+			 UNION ALL
+			 SELECT date_trunc('hour', timestamp), 1, ARRAY[product_id::bigint],
+			 CASE WHEN deal_shown THEN 1 ELSE 0 END, CASE WHEN code_copied THEN 1 ELSE 0 END
+			 FROM visitor
+			 WHERE store = $1 AND timestamp >= $2 AND timestamp < $3
+			 AND (timestamp < $4 OR timestamp >= $5)`
+
+/*
+rollupArgs are the args of checkoutHours and visitorHours. When the window
+holds no whole hour $4 is past $5, the rollup part is empty and every row in
+the window is read raw.
+*/
+func rollupArgs(id int, from time.Time, to time.Time) []interface{} {
+	first := from.UTC().Truncate(time.Hour)
+	if first.Before(from) {
+		first = first.Add(time.Hour)
+	}
+	last := to.UTC().Truncate(time.Hour)
+	return []interface{}{id, from.UTC(), to.UTC(), first, last}
+}
+
+/*
+seriesBucket is the start of an hour's bucket, truncated in the store's zone
+and returned as an instant so repeated wall clock hours stay apart. Hours are
+in UTC, $6 is the granularity and $7 the zone. Zones off UTC by a fraction of
+an hour get their buckets shifted by that fraction.
+*/
+const seriesBucket = `date_trunc($6, hour AT TIME ZONE 'UTC', $7)`
+
+/* seriesArgs are the query args of a series statement over the rollup hours using seriesBucket */
+func seriesArgs(q models.AnalyticsQuery, id int) []interface{} {
+	return append(rollupArgs(id, q.From, q.To), q.Granularity, q.Location.String())
+}
+
+/* Sync has nothing to copy, the postgres analytics read the transactional rows */
+func (m *postgresDBRepo) Sync(limit int) (int, error) {
+	return 0, nil
+}
+
+/*
+RefreshRollups recomputes up to limit hours that visitor and checkout writes
+marked dirty, oldest first, and returns how many it did. Instances running it
+at once take different hours. A row written while an hour is being recomputed
+marks it dirty again, so the next pass picks it up.
+*/
+func (m *postgresDBRepo) RefreshRollups(limit int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stmt := `WITH d AS (
+				DELETE FROM rollup_dirty
+				WHERE (store, hour) IN (
+					SELECT store, hour FROM rollup_dirty
+					ORDER BY hour LIMIT $1
+					FOR UPDATE SKIP LOCKED
+				)
+				RETURNING store, hour
+			 )
+			 INSERT INTO hourly_rollup (store, hour, gmv, discount, users, product_ids,
+			 impressions, code_copies, conversions, created_at, updated_at)
+			 SELECT d.store, d.hour, COALESCE(ck.gmv, 0), COALESCE(ck.discount, 0),
+			 COALESCE(v.users, 0), COALESCE(v.product_ids, '{}'), COALESCE(v.impressions, 0),
+			 COALESCE(v.code_copies, 0), COALESCE(ck.conversions, 0), now(), now()
+			 FROM d
+			 JOIN store s ON s.id = d.store
+			 LEFT JOIN LATERAL (
+				SELECT SUM(gmv) AS gmv, SUM(discount_amount) AS discount,
+				COUNT(DISTINCT order_id) AS conversions
+				FROM checkout
+				WHERE store = d.store AND timestamp >= d.hour AND timestamp < d.hour + interval '1 hour'
+			 ) ck ON true
+			 LEFT JOIN LATERAL (
+				SELECT COUNT(anonymous_id) AS users, array_agg(DISTINCT product_id::bigint) AS product_ids,
+				COUNT(*) FILTER (WHERE deal_shown) AS impressions,
+				COUNT(*) FILTER (WHERE code_copied) AS code_copies
+				FROM visitor
+				WHERE store = d.store AND timestamp >= d.hour AND timestamp < d.hour + interval '1 hour'
+			 ) v ON true
+			 ON CONFLICT (store, hour) DO UPDATE
+			 SET gmv = EXCLUDED.gmv, discount = EXCLUDED.discount, users = EXCLUDED.users,
+			 product_ids = EXCLUDED.product_ids, impressions = EXCLUDED.impressions,
+			 code_copies = EXCLUDED.code_copies, conversions = EXCLUDED.conversions,
+			 updated_at = now()`
+
+	res, err := m.DB.ExecContext(ctx, stmt, limit)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+/*
+RotateStoreTokens seals the tokens of up to limit stores after the store id
+after with the primary key, tokens stored in plaintext or under an older key.
+Rows are locked while rewritten so a reinstall waits and then writes over them.
+Returns how many were rotated and the id of the last store looked at, 0 when
+none was left. A store whose token can't be opened is passed over, paging on
+the id keeps it from holding up the stores after it.
+*/
+func (m *postgresDBRepo) RotateStoreTokens(after int, limit int) (int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `SELECT id, name, api_token, refresh_token FROM store
+			 WHERE id > $3
+			 AND ((api_token <> '' AND left(api_token, length($1::text)) <> $1::text)
+			 OR (refresh_token <> '' AND left(refresh_token, length($1::text)) <> $1::text))
+			 ORDER BY id LIMIT $2
+			 FOR UPDATE SKIP LOCKED`
+
+	rows, err := tx.QueryContext(ctx, stmt, m.App.Tokens.Prefix(), limit, after)
+	if err != nil {
+		return 0, 0, err
+	}
+	stores := []models.Store{}
+	for rows.Next() {
+		var s models.Store
+		if err = rows.Scan(&s.ID, &s.Name, &s.ApiToken, &s.RefreshToken); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		stores = append(stores, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(stores) == 0 {
+		return 0, 0, nil
 	}
 
-	return otf, nil
+	n := 0
+	for _, s := range stores {
+		api, err := m.App.Tokens.Rotate(s.ApiToken, s.TokenContext("api_token"))
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to rotate the api token of", s.Name, err)
+			continue
+		}
+		refresh, err := m.App.Tokens.Rotate(s.RefreshToken, s.TokenContext("refresh_token"))
+		if err != nil {
+			m.App.ErrorLog.Println("Failed to rotate the refresh token of", s.Name, err)
+			continue
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE store SET api_token = $2, refresh_token = $3 WHERE id = $1`,
+			s.ID, api, refresh)
+		if err != nil {
+			m.App.ErrorLog.Println("DB insertion failed")
+			return 0, 0, err
+		}
+		n++
+	}
+	return n, stores[len(stores)-1].ID, tx.Commit()
 }
 
+/*
+GetAllCampaigns lists the store's campaigns, newest first, the open one with
+live metrics. Campaign times are stored in UTC and returned in the store's zone.
+*/
 func (m *postgresDBRepo) GetAllCampaigns(id int) ([]models.Campaign, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT
-    		 DATE_TRUNC('day', visitor.timestamp) AS time_window,
-    		 COALESCE(SUM(checkout.discount_amount),0) AS discount,
-			 COALESCE(SUM(checkout.gmv),0) AS gmv,
-			 COALESCE(COUNT(*),0) as users,
-			 COUNT(DISTINCT visitor.product_id) AS products,
-			 AVG(checkout.gmv) AS aov,
-			 COUNT(CASE WHEN visitor.deal_shown = true THEN 1 ELSE NULL END) AS impressions,
-			 COUNT(CASE WHEN visitor.code_copied = true THEN 1 ELSE NULL END) AS promo_copied,
-			 COUNT(CASE WHEN checkout.gmv IS NOT NULL THEN 1 ELSE NULL END) AS conversions
-
-			 FROM visitor LEFT OUTER JOIN checkout
-			 ON visitor.discount_code = checkout.discount_code AND visitor.store = checkout.store
-			 
-			 WHERE visitor.timestamp >= $1 AND visitor.store = $2
-			 
-			 GROUP BY time_window
-			 ORDER BY time_window DESC`
+	store, err := m.GetStoreByID(id)
+	if err != nil {
+		return nil, err
+	}
+	loc := store.Location()
+
+	stmt := `SELECT c.id, c.starts_at, c.ends_at, c.status, c.default_discount, c.discount_category,
+			 c.max_discount,
+			 COALESCE(c.discount_value, mt.discount_value, 0), COALESCE(c.gmv_value, mt.gmv_value, 0),
+			 COALESCE(c.users, mt.users, 0), COALESCE(c.products, mt.products, 0),
+			 COALESCE(c.aov, mt.aov, 0), COALESCE(c.impressions, mt.impressions, 0),
+			 COALESCE(c.promo_copied, mt.promo_copied, 0),
+			 COALESCE(c.successful_redemptions, mt.successful_redemptions, 0),
+			 COALESCE(c.conversions, mt.conversions, 0)
+			 FROM campaign c LEFT JOIN (` + campaignMetrics + `) mt
+			 ON mt.id = c.id
+			 WHERE c.store = $1
+			 ORDER BY c.starts_at DESC`
 
 	j := []models.Campaign{}
 
-	t, err := m.GetCampignEndTime(id)
-	t.AddDate(-1, 0, 0)
-	rows, err := m.DB.QueryContext(ctx, stmt, t, id)
+	rows, err := m.DB.QueryContext(ctx, stmt, id)
 	if err != nil {
 		return j, err
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var c models.Campaign
-		err = rows.Scan(&c.StartTime, &c.DiscountValue, &c.GmvValue, &c.Users,
-			&c.Products, &c.Aov, &c.Impressions, &c.PromoCopied, &c.Conversions)
+		err = rows.Scan(&c.ID, &c.StartTime, &c.EndTime, &c.Status, &c.DefaultDiscount,
+			&c.DiscountCategory, &c.MaxDiscount, &c.DiscountValue, &c.GmvValue, &c.Users,
+			&c.Products, &c.Aov, &c.Impressions, &c.PromoCopied, &c.SuccessfulRedemptions,
+			&c.Conversions)
 		if err != nil {
 			return j, err
 		}
+		c.StartTime = c.StartTime.In(loc)
+		c.EndTime = c.EndTime.In(loc)
 		j = append(j, c)
 	}
 
-	return j, nil
+	return j, rows.Err()
 }
 
 func (m *postgresDBRepo) UpdateDealListConfig(id int, md int8, pc string, bs int8, bc string) error {
@@ -623,12 +618,43 @@ func (m *postgresDBRepo) UpdateDealListConfig(id int, md int8, pc string, bs int
 	return nil
 }
 
+/* storeColumns is the column list scanned by scanStore */
+const storeColumns = `id, name, api_token, refresh_token, misc, url,
+			 popup_color_code, button_color_code, default_discount,
+			 discount_category, max_discount_for_popup, button_style,
+			 campaign_renewal_time, campaign_turn_off_time, deal_list_active, currency,
+			 public_key, timezone`
+
+/* scanStore reads the current row of a query selecting storeColumns */
+func scanStore(rows *sql.Rows) (models.Store, error) {
+	j := models.Store{}
+	var crt, ctt sql.NullString
+	var pk sql.NullString
+	err := rows.Scan(&j.ID, &j.Name, &j.ApiToken, &j.RefreshToken, &j.Misc, &j.URL,
+		&j.PopupColorCode, &j.ButtonColorCode, &j.DefaultDiscount,
+		&j.DiscountCateogry, &j.MaxDiscountforPopup, &j.ButtonStyle,
+		&crt, &ctt, &j.DealListActive, &j.Currency, &pk, &j.Timezone)
+	j.PublicKey = pk.String
+	j.CampaginRenewalTime = parseClock(crt.String)
+	j.CampaignTurnOffTime = parseClock(ctt.String)
+	return j, err
+}
+
+/* parseClock reads a postgres time column, only hour:min:sec are kept */
+func parseClock(s string) time.Time {
+	if len(s) > 8 {
+		s = s[:8]
+	}
+	t, _ := time.Parse("15:04:05", s)
+	return t
+}
+
 func (m *postgresDBRepo) GetStoreByID(id int) (models.Store, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `SELECT *  
-			 FROM store 
+	stmt := `SELECT ` + storeColumns + `
+			 FROM store
 			 WHERE id = $1`
 	j := models.Store{}
 	rows, err := m.DB.QueryContext(ctx, stmt, id)
@@ -637,11 +663,7 @@ func (m *postgresDBRepo) GetStoreByID(id int) (models.Store, error) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var crt, ctt string
-		err = rows.Scan(&j.ID, &j.Name, &j.ApiToken, &j.RefreshToken, &j.Misc, &j.URL,
-			&j.PopupColorCode, &j.ButtonColorCode, &j.DefaultDiscount,
-			&j.DiscountCateogry, &j.MaxDiscountforPopup, &j.ButtonStyle,
-			&crt, &ctt, &j.DealListActive, &j.Currency)
+		j, err = scanStore(rows)
 		if err != nil {
 			return j, err
 		}
@@ -680,8 +702,12 @@ func (m *postgresDBRepo) GetConfiguredDiscounts(id int, cat int8) (map[int64]int
 	defer cancel()
 
 	stmt := ``
-	var mp map[int64]int8
+	mp := make(map[int64]int8)
 	switch cat {
+	case 1:
+		stmt = `SELECT store, discount_percentage
+				FROM store_discount
+				WHERE store = $1`
 	case 2:
 		stmt = `SELECT product_id, discount_percentage
 				FROM product
@@ -779,42 +805,1456 @@ func (m *postgresDBRepo) GetUserProfileInfo(id int) (models.UserProfile, error)
 	return info, nil
 }
 
-func (m *postgresDBRepo) UpdateDiscounts(id int, dc int8, mp map[int64]int8) error {
-	//ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	//defer cancel()
-
-	return nil
-	// isme naya kaam hai, dimaag lagaana hai
+/* configuredDiscount is a store, product or collection row with its shopify price rule and code */
+type configuredDiscount struct {
+	perc        int8
+	priceRuleID int64
+	codeID      int64
 }
 
-func (m *postgresDBRepo) UpdateDiscountDefaults(id int, def int8, cat int8) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+/*
+UpdateDiscounts syncs the store wide (cat 1), product (cat 2) or collection (cat 3)
+discounts with mp. The store wide discount is the store's default discount, mp
+is not read for it. Shopify price rules and the code of every entry are created
+and updated first and undone if anything after them fails. Visitors never get
+the entry's code, they get single use codes from the pool under the price rule.
+Removed entries are dropped in the same transaction and their price rules queued
+for deletion, a rule shopify fails to delete now is retried by the code reaper.
+*/
+func (m *postgresDBRepo) UpdateDiscounts(id int, dc int8, mp map[int64]int8) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	stmt := `UPDATE store
-			 SET default_discount = $2, discount_category = $3
-			 WHERE id = $1`
-
-	_, err := m.DB.ExecContext(ctx, stmt, id, def, cat)
+	store, err := m.GetStoreByID(id)
 	if err != nil {
-		m.App.ErrorLog.Println("DB insertion failed")
 		return err
 	}
-	return nil
-}
 
-func (m *postgresDBRepo) UpdateUserProfile(id int, fn string, ln string, p string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	/* the store wide rows are keyed by the store alone, the entry is the store id */
+	var table, column, prefix string
+	switch dc {
+	case 1:
+		table, column, prefix = "store_discount", "store", "S"
+		mp = make(map[int64]int8)
+		if store.DefaultDiscount > 0 {
+			mp[int64(id)] = store.DefaultDiscount
+		}
+	case 2:
+		table, column, prefix = "product", "product_id", "P"
+	case 3:
+		table, column, prefix = "collection", "collection_id", "C"
+	default:
+		return nil
+	}
+	for ident, perc := range mp {
+		if !helpers.IsValidDiscount(perc) {
+			return fmt.Errorf("discount of %d is %d%%, it must be between 1 and 100", ident, perc)
+		}
+	}
 
-	stmt := `UPDATE store
-			 SET first_name = $2, last_name = $3, photo = $4
-			 WHERE id = $1`
+	stmt := fmt.Sprintf(`SELECT %[2]s, discount_percentage, COALESCE(price_rule_id, 0), COALESCE(discount_code, 0)
+			 FROM %[1]s
+			 WHERE store = $1`, table, column)
 
-	_, err := m.DB.ExecContext(ctx, stmt, id, fn, ln, p)
+	rows, err := m.DB.QueryContext(ctx, stmt, id)
 	if err != nil {
-		m.App.ErrorLog.Println("DB insertion failed")
 		return err
 	}
-	return nil
+	existing := make(map[int64]configuredDiscount)
+	for rows.Next() {
+		var ident int64
+		var c configuredDiscount
+		err = rows.Scan(&ident, &c.perc, &c.priceRuleID, &c.codeID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		existing[ident] = c
+	}
+	rows.Close()
+
+	/* undo holds the compensation for every shopify change made so far */
+	undo := []func() error{}
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				m.App.ErrorLog.Println("Shopify rollback failed:", err)
+			}
+		}
+	}
+
+	synced := make(map[int64]configuredDiscount)
+	codes := []models.DiscountCode{}
+	for ident, perc := range mp {
+		/* the title only names the rule in the shopify admin, it is not a code */
+		title := fmt.Sprintf("SLAASH-%s%d", prefix, ident)
+		c, found := existing[ident]
+		switch {
+		case found && c.priceRuleID != 0 && c.perc == perc:
+			/* the rule already has this percentage */
+		case found && c.priceRuleID != 0:
+			pr := models.NewDiscountPriceRule(title, dc, ident, perc)
+			pr.ID = c.priceRuleID
+			err = store.UpdatePriceRule(pr)
+			if err != nil {
+				rollback()
+				return err
+			}
+			old := models.NewDiscountPriceRule(title, dc, ident, c.perc)
+			old.ID = c.priceRuleID
+			undo = append(undo, func() error { return store.UpdatePriceRule(old) })
+			c.perc = perc
+		default:
+			prId, err := store.CreatePriceRule(models.NewDiscountPriceRule(title, dc, ident, perc))
+			if err != nil {
+				rollback()
+				return err
+			}
+			undo = append(undo, func() error { return store.DeletePriceRule(prId) })
+			c = configuredDiscount{perc: perc, priceRuleID: prId}
+		}
+
+		/* entries saved before their code was kept get one too */
+		if c.codeID == 0 {
+			code, err := helpers.NewDiscountCode()
+			if err != nil {
+				rollback()
+				return err
+			}
+			prId := c.priceRuleID
+			codeID, err := store.CreateDiscountByPrID(prId, goshopify.PriceRuleDiscountCode{Code: code})
+			if err != nil {
+				rollback()
+				return err
+			}
+			undo = append(undo, func() error { return store.DeleteDiscountByDiscId(codeID, prId) })
+			c.codeID = codeID
+			codes = append(codes, models.DiscountCode{
+				ShopifyID:   codeID,
+				Store:       id,
+				PriceRuleID: prId,
+				Code:        code,
+				Timestamp:   time.Now(),
+			})
+		}
+		synced[ident] = c
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		rollback()
+		return err
+	}
+	defer tx.Rollback()
+
+	codeStmt := `INSERT INTO discount_code (shopify_id, store, price_rule_id, code, timestamp, pooled)
+			 VALUES ($1, $2, $3, $4, $5, false)`
+	for _, c := range codes {
+		_, err = tx.ExecContext(ctx, codeStmt, c.ShopifyID, c.Store, c.PriceRuleID, c.Code, c.Timestamp)
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	upsertStmt := fmt.Sprintf(`INSERT INTO %[1]s (store, %[2]s, discount_percentage, price_rule_id, discount_code, impressions)
+			 VALUES ($1, $2, $3, $4, $5, 0)
+			 ON CONFLICT (store, %[2]s) DO UPDATE
+			 SET discount_percentage = EXCLUDED.discount_percentage, price_rule_id = EXCLUDED.price_rule_id,
+			 discount_code = EXCLUDED.discount_code`,
+		table, column)
+	deleteStmt := fmt.Sprintf(`DELETE FROM %s WHERE store = $1 AND %s = $2`, table, column)
+	/* entryArgs drops the entry for the store wide row, its key is the store */
+	entryArgs := func(ident int64, args ...interface{}) []interface{} {
+		if dc == 1 {
+			return append([]interface{}{id}, args...)
+		}
+		return append([]interface{}{id, ident}, args...)
+	}
+	if dc == 1 {
+		upsertStmt = `INSERT INTO store_discount (store, discount_percentage, price_rule_id, discount_code)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (store) DO UPDATE
+			 SET discount_percentage = EXCLUDED.discount_percentage, price_rule_id = EXCLUDED.price_rule_id,
+			 discount_code = EXCLUDED.discount_code`
+		deleteStmt = `DELETE FROM store_discount WHERE store = $1`
+	}
+
+	for ident, c := range synced {
+		_, err = tx.ExecContext(ctx, upsertStmt, entryArgs(ident, c.perc, c.priceRuleID, c.codeID)...)
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	retireStmt := `INSERT INTO retired_price_rule (store, price_rule_id)
+			 VALUES ($1, $2)
+			 ON CONFLICT DO NOTHING`
+	retired := []int64{}
+	for ident, c := range existing {
+		if _, keep := mp[ident]; keep {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, deleteStmt, entryArgs(ident)...); err != nil {
+			rollback()
+			return err
+		}
+		if c.priceRuleID == 0 {
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, retireStmt, id, c.priceRuleID); err != nil {
+			rollback()
+			return err
+		}
+		retired = append(retired, c.priceRuleID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		rollback()
+		return err
+	}
+
+	/* the discounts are saved, a rule that can't be deleted now stays queued */
+	for _, prId := range retired {
+		if err := store.DeletePriceRule(prId); err != nil {
+			m.App.ErrorLog.Println("Failed to delete price rule", prId, "retrying later:", err)
+			continue
+		}
+		if err := m.DropRetiredPriceRule(id, prId); err != nil {
+			m.App.ErrorLog.Println(err)
+		}
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) UpdateDiscountDefaults(id int, def int8, cat int8) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE store
+			 SET default_discount = $2, discount_category = $3
+			 WHERE id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id, def, cat)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) UpdateUserProfile(id int, fn string, ln string, p string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE store
+			 SET first_name = $2, last_name = $3, photo = $4
+			 WHERE id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id, fn, ln, p)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+/*
+InstallStore saves the store and its owner in one transaction and returns the
+store id and the owner. A reinstall keeps the store's owner. A merchant who
+already has a user for another store gets the new store linked to it, the
+user is only created when the email is new. owner.Password is the plain
+password for a new user.
+*/
+func (m *postgresDBRepo) InstallStore(s models.Store, owner models.Users) (int, models.Users, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, owner, err
+	}
+	defer tx.Rollback()
+
+	/* the public key is only set on the first install */
+	stmt := `INSERT INTO store (name, api_token, url, currency, public_key, timezone)
+			 VALUES ($1, $2, $3, $4, $5, $6)
+			 ON CONFLICT (name) DO UPDATE
+			 SET api_token = EXCLUDED.api_token, url = EXCLUDED.url, currency = EXCLUDED.currency,
+			 timezone = EXCLUDED.timezone
+			 RETURNING id, owner`
+
+	var id int
+	var ownerID sql.NullInt64
+	err = tx.QueryRowContext(ctx, stmt, s.Name, s.ApiToken, s.URL, s.Currency, s.PublicKey,
+		s.Timezone).Scan(&id, &ownerID)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return 0, owner, err
+	}
+
+	if !ownerID.Valid {
+		hash, err := hashPassword(owner.Password)
+		if err != nil {
+			return 0, owner, err
+		}
+		now := time.Now().UTC()
+		stmt = `INSERT INTO users (first_name, last_name, email, password, access_level,
+				 created_at, updated_at, store, photo, misc)
+				 VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8, $9)
+				 ON CONFLICT (email) DO NOTHING
+				 RETURNING id`
+		err = tx.QueryRowContext(ctx, stmt, owner.FirstName, owner.LastName, owner.Email, hash,
+			owner.AccessLevel, now, id, owner.Photo, owner.Misc).Scan(&ownerID)
+		if err == sql.ErrNoRows {
+			err = tx.QueryRowContext(ctx, `SELECT id FROM users WHERE email = $1`, owner.Email).Scan(&ownerID)
+		}
+		if err != nil {
+			m.App.ErrorLog.Println("DB insertion failed")
+			return 0, owner, err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE store SET owner = $2 WHERE id = $1`, id, ownerID.Int64)
+		if err != nil {
+			m.App.ErrorLog.Println("DB insertion failed")
+			return 0, owner, err
+		}
+	}
+
+	stmt = `SELECT first_name, last_name, email, access_level, created_at, updated_at, photo, misc
+			 FROM users
+			 WHERE id = $1`
+	u := models.Users{Store: id}
+	err = tx.QueryRowContext(ctx, stmt, ownerID.Int64).Scan(&u.FirstName, &u.LastName, &u.Email,
+		&u.AccessLevel, &u.CreatedAt, &u.UpdatedAt, &u.Photo, &u.Misc)
+	if err != nil {
+		m.App.ErrorLog.Println("DB extraction failed")
+		return 0, owner, err
+	}
+	return id, u, tx.Commit()
+}
+
+func (m *postgresDBRepo) UpdateStoreTimezone(id int, tz string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE store
+			 SET timezone = $1
+			 WHERE id = $2`
+
+	_, err := m.DB.ExecContext(ctx, stmt, tz, id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) GetOwnerByStoreID(id int) (models.Users, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var u models.Users
+	found := false
+
+	stmt := `SELECT first_name, last_name, email, password, access_level,
+			 created_at, updated_at, store, photo, misc
+			 FROM users
+			 WHERE id = (SELECT owner FROM store WHERE id = $1)`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB extraction failed")
+		return u, found, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fn, ln, e, pw, ph, msc sql.NullString
+		var ca, ua sql.NullTime
+		var al, s sql.NullInt64
+
+		err := rows.Scan(&fn, &ln, &e, &pw,
+			&al, &ca, &ua, &s, &ph, &msc)
+		if err != nil {
+			m.App.ErrorLog.Println("User Assignment Failed")
+			return u, found, err
+		}
+		found = true
+		u.FirstName = fn.String
+		u.LastName = ln.String
+		u.Password = pw.String
+		u.AccessLevel = int(al.Int64)
+		u.CreatedAt = ca.Time
+		u.UpdatedAt = ua.Time
+		u.Store = int(s.Int64)
+		u.Photo = ph.String
+		u.Email = e.String
+		u.Misc = msc.String
+	}
+	return u, found, nil
+}
+
+/* InsertUser creates a user, u.Password is the plain password and is stored hashed */
+func (m *postgresDBRepo) InsertUser(u models.Users) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO users (first_name, last_name, email, password, access_level,
+			 created_at, updated_at, store, photo, misc)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DB.ExecContext(ctx, stmt, u.FirstName, u.LastName, u.Email, hash,
+		u.AccessLevel, u.CreatedAt, u.UpdatedAt, u.Store, u.Photo, u.Misc)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) GetStoreByName(name string) (models.Store, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + storeColumns + `
+			 FROM store
+			 WHERE name = $1`
+	j := models.Store{}
+	found := false
+	rows, err := m.DB.QueryContext(ctx, stmt, name)
+	if err != nil {
+		return j, found, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err = scanStore(rows)
+		if err != nil {
+			return j, found, err
+		}
+		found = true
+	}
+	return j, found, nil
+}
+
+func (m *postgresDBRepo) GetStoreByPublicKey(key string) (models.Store, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + storeColumns + `
+			 FROM store
+			 WHERE public_key = $1`
+	j := models.Store{}
+	found := false
+	rows, err := m.DB.QueryContext(ctx, stmt, key)
+	if err != nil {
+		return j, found, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j, err = scanStore(rows)
+		if err != nil {
+			return j, found, err
+		}
+		found = true
+	}
+	return j, found, nil
+}
+
+/* InsertWebhookDelivery returns false if the delivery was already recorded */
+func (m *postgresDBRepo) InsertWebhookDelivery(id string, shop string, topic string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO webhook_delivery (webhook_id, shop, topic, created_at, updated_at)
+			 VALUES ($1, $2, $3, now(), now())
+			 ON CONFLICT (webhook_id) DO NOTHING`
+
+	res, err := m.DB.ExecContext(ctx, stmt, id, shop, topic)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (m *postgresDBRepo) DeleteWebhookDelivery(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `DELETE FROM webhook_delivery
+			 WHERE webhook_id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB deletion failed")
+		return err
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) UninstallStore(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE store
+			 SET api_token = '', refresh_token = '', deal_list_active = false
+			 WHERE id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) GetDiscountCodeByCode(id int, code string) (models.DiscountCode, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var dc models.DiscountCode
+	found := false
+
+	/* shopify codes are case insensitive */
+	stmt := `SELECT shopify_id, store, price_rule_id, code, timestamp, pooled, issued_at, expires_at
+			 FROM discount_code
+			 WHERE store = $1 AND LOWER(code) = LOWER($2)`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, id, code)
+	if err != nil {
+		return dc, found, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ia, ea sql.NullTime
+		err = rows.Scan(&dc.ShopifyID, &dc.Store, &dc.PriceRuleID, &dc.Code, &dc.Timestamp,
+			&dc.Pooled, &ia, &ea)
+		if err != nil {
+			return dc, found, err
+		}
+		dc.IssuedAt = ia.Time
+		dc.ExpiresAt = ea.Time
+		found = true
+	}
+	return dc, found, nil
+}
+
+/* GetAnonymousIDByDiscountCode returns the visitor the code was issued to, or "" */
+func (m *postgresDBRepo) GetAnonymousIDByDiscountCode(id int, dc int64) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT anonymous_id
+			 FROM visitor
+			 WHERE store = $1 AND discount_code = $2
+			 ORDER BY timestamp DESC
+			 LIMIT 1`
+
+	var aid sql.NullString
+	err := m.DB.QueryRowContext(ctx, stmt, id, dc).Scan(&aid)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return aid.String, nil
+}
+
+func (m *postgresDBRepo) InsertCheckouts(cs []models.Checkout) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	/* line items are unique, a replayed order does not double count */
+	/* the checkout counts for the campaign its code was issued in */
+	stmt := `INSERT INTO checkout (anonymous_id, store, order_id, line_item_id, product_id,
+			 gmv, discount_amount, discount_code, timestamp, campaign_id)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9,
+			 (SELECT campaign_id FROM visitor WHERE store = $2 AND discount_code = $8
+			  ORDER BY timestamp DESC LIMIT 1))
+			 ON CONFLICT (line_item_id) DO NOTHING`
+
+	for _, c := range cs {
+		_, err = tx.ExecContext(ctx, stmt, c.AnonymousID, c.Store, c.OrderID, c.LineItemID,
+			c.ProductID, c.GMV, c.DiscountAmount, c.DiscountCode, c.Timestamp.UTC())
+		if err != nil {
+			m.App.ErrorLog.Println("DB insertion failed")
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/* UpsertAbandonedCheckout records the state of a checkout, an older delivery never overwrites a newer one */
+func (m *postgresDBRepo) UpsertAbandonedCheckout(c models.AbandonedCheckout) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var completed sql.NullTime
+	if !c.CompletedAt.IsZero() {
+		completed = sql.NullTime{Time: c.CompletedAt.UTC(), Valid: true}
+	}
+
+	stmt := `INSERT INTO abandoned_checkout (store, checkout_id, anonymous_id, discount_code,
+			 total_price, total_discounts, completed_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			 ON CONFLICT (store, checkout_id) DO UPDATE
+			 SET anonymous_id = EXCLUDED.anonymous_id, discount_code = EXCLUDED.discount_code,
+			 total_price = EXCLUDED.total_price, total_discounts = EXCLUDED.total_discounts,
+			 completed_at = EXCLUDED.completed_at, updated_at = EXCLUDED.updated_at
+			 WHERE abandoned_checkout.updated_at <= EXCLUDED.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, c.Store, c.CheckoutID, c.AnonymousID, c.DiscountCode,
+		c.TotalPrice, c.TotalDiscounts, completed, c.UpdatedAt.UTC())
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+/*
+GetPriceRuleForProduct returns the price rule of the store wide (cat 1), product
+(cat 2) or collection (cat 3) discount, ident is not read for cat 1.
+*/
+func (m *postgresDBRepo) GetPriceRuleForProduct(id int, cat int8, ident int64) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := ``
+	args := []interface{}{id, ident}
+	switch cat {
+	case 1:
+		stmt = `SELECT price_rule_id
+				FROM store_discount
+				WHERE store = $1 AND price_rule_id IS NOT NULL`
+		args = args[:1]
+	case 2:
+		stmt = `SELECT price_rule_id
+				FROM product
+				WHERE store = $1 AND product_id = $2 AND price_rule_id IS NOT NULL`
+	case 3:
+		stmt = `SELECT price_rule_id
+				FROM collection
+				WHERE store = $1 AND collection_id = $2 AND price_rule_id IS NOT NULL`
+	default:
+		return 0, false, nil
+	}
+
+	var prId int64
+	err := m.DB.QueryRowContext(ctx, stmt, args...).Scan(&prId)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return prId, true, nil
+}
+
+func (m *postgresDBRepo) CountPooledCodes(id int, prId int64) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT COUNT(*)
+			 FROM discount_code
+			 WHERE store = $1 AND price_rule_id = $2 AND pooled AND issued_at IS NULL`
+
+	var n int
+	err := m.DB.QueryRowContext(ctx, stmt, id, prId).Scan(&n)
+	return n, err
+}
+
+func (m *postgresDBRepo) InsertDiscountCodes(cs []models.DiscountCode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO discount_code (shopify_id, store, price_rule_id, code, timestamp, pooled)
+			 VALUES ($1, $2, $3, $4, $5, $6)`
+
+	for _, c := range cs {
+		_, err = tx.ExecContext(ctx, stmt, c.ShopifyID, c.Store, c.PriceRuleID, c.Code, c.Timestamp, c.Pooled)
+		if err != nil {
+			m.App.ErrorLog.Println("DB insertion failed")
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/* ClaimDiscountCode hands out one unissued pooled code, safe across concurrent callers */
+func (m *postgresDBRepo) ClaimDiscountCode(id int, prId int64, expires time.Time) (models.DiscountCode, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE discount_code
+			 SET issued_at = (now() AT TIME ZONE 'UTC'), expires_at = $3
+			 WHERE shopify_id = (
+				SELECT shopify_id
+				FROM discount_code
+				WHERE store = $1 AND price_rule_id = $2 AND pooled AND issued_at IS NULL
+				LIMIT 1
+				FOR UPDATE SKIP LOCKED
+			 )
+			 RETURNING shopify_id, store, price_rule_id, code, timestamp, issued_at, expires_at`
+
+	dc := models.DiscountCode{Pooled: true}
+	err := m.DB.QueryRowContext(ctx, stmt, id, prId, expires).Scan(&dc.ShopifyID, &dc.Store,
+		&dc.PriceRuleID, &dc.Code, &dc.Timestamp, &dc.IssuedAt, &dc.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return dc, false, nil
+	}
+	if err != nil {
+		return dc, false, err
+	}
+	return dc, true, nil
+}
+
+/*
+GetExpiredDiscountCodes lists codes past their expiry that are still live on
+shopify, issued codes whose timer ran out and the retired shared codes.
+*/
+func (m *postgresDBRepo) GetExpiredDiscountCodes(limit int) ([]models.DiscountCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT shopify_id, store, price_rule_id, code, timestamp, pooled,
+			 COALESCE(issued_at, expires_at), expires_at
+			 FROM discount_code
+			 WHERE expires_at < (now() AT TIME ZONE 'UTC')
+			 AND redeemed_at IS NULL AND revoked_at IS NULL
+			 ORDER BY expires_at
+			 LIMIT $1`
+
+	codes := []models.DiscountCode{}
+	rows, err := m.DB.QueryContext(ctx, stmt, limit)
+	if err != nil {
+		return codes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dc models.DiscountCode
+		err = rows.Scan(&dc.ShopifyID, &dc.Store, &dc.PriceRuleID, &dc.Code, &dc.Timestamp,
+			&dc.Pooled, &dc.IssuedAt, &dc.ExpiresAt)
+		if err != nil {
+			return codes, err
+		}
+		codes = append(codes, dc)
+	}
+	return codes, nil
+}
+
+func (m *postgresDBRepo) RedeemDiscountCode(sid int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE discount_code
+			 SET redeemed_at = (now() AT TIME ZONE 'UTC')
+			 WHERE shopify_id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, sid)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+func (m *postgresDBRepo) RevokeDiscountCode(sid int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE discount_code
+			 SET revoked_at = (now() AT TIME ZONE 'UTC')
+			 WHERE shopify_id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, sid)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+/* GetRetiredPriceRules lists the price rules of removed discounts still live on shopify, oldest first */
+func (m *postgresDBRepo) GetRetiredPriceRules(limit int) ([]models.RetiredPriceRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT store, price_rule_id, retired_at
+			 FROM retired_price_rule
+			 ORDER BY retired_at
+			 LIMIT $1`
+
+	rules := []models.RetiredPriceRule{}
+	rows, err := m.DB.QueryContext(ctx, stmt, limit)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r models.RetiredPriceRule
+		if err = rows.Scan(&r.Store, &r.PriceRuleID, &r.RetiredAt); err != nil {
+			return rules, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+/* DropRetiredPriceRule forgets a price rule deleted on shopify along with its codes */
+func (m *postgresDBRepo) DropRetiredPriceRule(id int, prId int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM discount_code WHERE store = $1 AND price_rule_id = $2`, id, prId)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM retired_price_rule WHERE store = $1 AND price_rule_id = $2`, id, prId)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return tx.Commit()
+}
+
+/* InsertVisitor starts a funnel row and returns its id */
+func (m *postgresDBRepo) InsertVisitor(v models.Visitor) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	/* the visitor belongs to the campaign running when the deal was shown */
+	stmt := `INSERT INTO visitor (anonymous_id, store, product_id, timestamp, discount_code,
+			 timer_in_minutes, deal_shown, deal_clicked, code_shown, code_copied, misc,
+			 deal_shown_at, deal_clicked_at, code_shown_at, code_copied_at, campaign_id)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+			 (SELECT id FROM campaign WHERE store = $2 AND starts_at <= $4 AND ends_at > $4
+			  ORDER BY starts_at DESC LIMIT 1))
+			 RETURNING id`
+
+	var id int64
+	err := m.DB.QueryRowContext(ctx, stmt, v.AnonymousID, v.Store, v.ProductId, v.Timestamp.UTC(),
+		v.DiscountCode, v.TimerInMinutes, v.DealShown, v.DealClicked, v.CodeShown, v.CodeCopied, v.Misc,
+		nullTime(v.DealShownAt), nullTime(v.DealClickedAt), nullTime(v.CodeShownAt),
+		nullTime(v.CodeCopiedAt)).Scan(&id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return 0, err
+	}
+	return id, nil
+}
+
+func (m *postgresDBRepo) GetOtfConfig(id int) (models.OtfConfig, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	c := models.OtfConfig{Store: id}
+
+	stmt := `SELECT threshold, weights
+			 FROM otf_config
+			 WHERE store = $1`
+
+	var weights []byte
+	err := m.DB.QueryRowContext(ctx, stmt, id).Scan(&c.Threshold, &weights)
+	if err == sql.ErrNoRows {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	err = json.Unmarshal(weights, &c.Weights)
+	if err != nil {
+		return c, false, err
+	}
+	return c, true, nil
+}
+
+/* UpdateOtfConfig saves the config and drops the store's cached verdicts, which were scored with the old one */
+func (m *postgresDBRepo) UpdateOtfConfig(c models.OtfConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	weights, err := json.Marshal(c.Weights)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO otf_config (store, threshold, weights, created_at, updated_at)
+			 VALUES ($1, $2, $3, now(), now())
+			 ON CONFLICT (store) DO UPDATE
+			 SET threshold = EXCLUDED.threshold, weights = EXCLUDED.weights, updated_at = now()`
+
+	_, err = tx.ExecContext(ctx, stmt, c.Store, c.Threshold, weights)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM visit_table WHERE store = $1`, c.Store)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *postgresDBRepo) GetOtfCache(aid string, id int) (models.OtfCache, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	c := models.OtfCache{AnonymousID: aid, Store: id}
+
+	stmt := `SELECT visit, score, threshold, otf, contributions, last_event_at, updated_at
+			 FROM visit_table
+			 WHERE anonymous_id = $1 AND store = $2`
+
+	var visit, contributions []byte
+	var lea sql.NullTime
+	err := m.DB.QueryRowContext(ctx, stmt, aid, id).Scan(&visit, &c.Result.Score,
+		&c.Result.Threshold, &c.Result.Otf, &contributions, &lea, &c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	c.LastEventAt = lea.Time
+	if err = json.Unmarshal(visit, &c.Visit); err != nil {
+		return c, false, err
+	}
+	if err = json.Unmarshal(contributions, &c.Result.Contributions); err != nil {
+		return c, false, err
+	}
+	return c, true, nil
+}
+
+func (m *postgresDBRepo) UpsertOtfCache(c models.OtfCache) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	visit, err := json.Marshal(c.Visit)
+	if err != nil {
+		return err
+	}
+	contributions, err := json.Marshal(c.Result.Contributions)
+	if err != nil {
+		return err
+	}
+	var lea sql.NullTime
+	if !c.LastEventAt.IsZero() {
+		lea = sql.NullTime{Time: c.LastEventAt, Valid: true}
+	}
+
+	stmt := `INSERT INTO visit_table (anonymous_id, store, visit, score, threshold, otf,
+			 contributions, last_event_at, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now(), now())
+			 ON CONFLICT (anonymous_id, store) DO UPDATE
+			 SET visit = EXCLUDED.visit, score = EXCLUDED.score, threshold = EXCLUDED.threshold,
+			 otf = EXCLUDED.otf, contributions = EXCLUDED.contributions,
+			 last_event_at = EXCLUDED.last_event_at, updated_at = now()`
+
+	_, err = m.DB.ExecContext(ctx, stmt, c.AnonymousID, c.Store, visit, c.Result.Score,
+		c.Result.Threshold, c.Result.Otf, contributions, lea)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+/* TouchOtfCache restarts the TTL of a verdict that is still current */
+func (m *postgresDBRepo) TouchOtfCache(aid string, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE visit_table
+			 SET updated_at = now()
+			 WHERE anonymous_id = $1 AND store = $2`
+
+	_, err := m.DB.ExecContext(ctx, stmt, aid, id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return err
+	}
+	return nil
+}
+
+/* GetLiveCodeForVisitor returns the unexpired code already issued to a visitor for a product */
+func (m *postgresDBRepo) GetLiveCodeForVisitor(id int, aid string, pid int64) (models.DiscountCode, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT d.shopify_id, d.store, d.price_rule_id, d.code, d.timestamp, d.issued_at, d.expires_at
+			 FROM visitor v JOIN discount_code d
+			 ON d.shopify_id = v.discount_code AND d.store = v.store
+			 WHERE v.store = $1 AND v.anonymous_id = $2 AND v.product_id = $3
+			 AND d.expires_at > (now() AT TIME ZONE 'UTC') AND d.redeemed_at IS NULL AND d.revoked_at IS NULL
+			 ORDER BY d.expires_at DESC
+			 LIMIT 1`
+
+	dc := models.DiscountCode{Pooled: true}
+	err := m.DB.QueryRowContext(ctx, stmt, id, aid, pid).Scan(&dc.ShopifyID, &dc.Store,
+		&dc.PriceRuleID, &dc.Code, &dc.Timestamp, &dc.IssuedAt, &dc.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return dc, false, nil
+	}
+	if err != nil {
+		return dc, false, err
+	}
+	return dc, true, nil
+}
+
+/* GetFunnel returns the latest funnel row of a visitor for a product started after since */
+func (m *postgresDBRepo) GetFunnel(id int, aid string, pid int64, since time.Time) (models.Visitor, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, anonymous_id, store, product_id, timestamp, discount_code, timer_in_minutes,
+			 deal_shown, deal_clicked, code_shown, code_copied,
+			 deal_shown_at, deal_clicked_at, code_shown_at, code_copied_at
+			 FROM visitor
+			 WHERE store = $1 AND anonymous_id = $2 AND product_id = $3 AND timestamp > $4
+			 ORDER BY timestamp DESC
+			 LIMIT 1`
+
+	var v models.Visitor
+	var dc sql.NullInt64
+	var timer sql.NullInt16
+	var shown, clicked, codeShown, copied sql.NullTime
+	err := m.DB.QueryRowContext(ctx, stmt, id, aid, pid, since).Scan(&v.ID, &v.AnonymousID, &v.Store,
+		&v.ProductId, &v.Timestamp, &dc, &timer, &v.DealShown, &v.DealClicked, &v.CodeShown,
+		&v.CodeCopied, &shown, &clicked, &codeShown, &copied)
+	if err == sql.ErrNoRows {
+		return v, false, nil
+	}
+	if err != nil {
+		return v, false, err
+	}
+	v.DiscountCode = dc.Int64
+	v.TimerInMinutes = int8(timer.Int16)
+	v.DealShownAt = shown.Time
+	v.DealClickedAt = clicked.Time
+	v.CodeShownAt = codeShown.Time
+	v.CodeCopiedAt = copied.Time
+	return v, true, nil
+}
+
+/* funnelColumns maps a funnel step to its flag, its timestamp and the flag it requires */
+var funnelColumns = map[string][3]string{
+	"deal_clicked": {"deal_clicked", "deal_clicked_at", "deal_shown"},
+	"code_copied":  {"code_copied", "code_copied_at", "code_shown"},
+}
+
+/*
+AdvanceFunnel marks a step done on a funnel row, only if the step before it is
+done and this one is not. Returns false when nothing was updated
+*/
+func (m *postgresDBRepo) AdvanceFunnel(vid int64, step string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	cols, ok := funnelColumns[step]
+	if !ok {
+		return false, fmt.Errorf("unknown funnel step %q", step)
+	}
+
+	stmt := fmt.Sprintf(`UPDATE visitor
+			 SET %[1]s = true, %[2]s = (now() AT TIME ZONE 'UTC')
+			 WHERE id = $1 AND %[3]s AND NOT %[1]s`, cols[0], cols[1], cols[2])
+
+	res, err := m.DB.ExecContext(ctx, stmt, vid)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+/* AttachCodeToVisitor records the code shown on a clicked funnel, false if it already has one */
+func (m *postgresDBRepo) AttachCodeToVisitor(vid int64, dc int64, timer int8) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE visitor
+			 SET discount_code = $2, timer_in_minutes = $3, code_shown = true, code_shown_at = (now() AT TIME ZONE 'UTC')
+			 WHERE id = $1 AND deal_clicked AND NOT code_shown`
+
+	res, err := m.DB.ExecContext(ctx, stmt, vid, dc, timer)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (m *postgresDBRepo) InsertThemeDeployment(d models.ThemeDeployment) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO theme_deployment (store, theme_id, asset_key, content_hash, content,
+			 previous_content, triggered_by, rollback_of, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now(), now())
+			 RETURNING id`
+
+	var rollbackOf sql.NullInt64
+	if d.RollbackOf != 0 {
+		rollbackOf = sql.NullInt64{Int64: d.RollbackOf, Valid: true}
+	}
+
+	var id int64
+	err := m.DB.QueryRowContext(ctx, stmt, d.Store, d.ThemeID, d.AssetKey, d.ContentHash, d.Content,
+		d.PreviousContent, d.TriggeredBy, rollbackOf).Scan(&id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return 0, err
+	}
+	return id, nil
+}
+
+/* GetThemeDeployments lists a store's latest deployments, newest first, without contents */
+func (m *postgresDBRepo) GetThemeDeployments(id int, limit int) ([]models.ThemeDeployment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, store, theme_id, asset_key, content_hash, triggered_by, rollback_of, created_at
+			 FROM theme_deployment
+			 WHERE store = $1
+			 ORDER BY created_at DESC, id DESC
+			 LIMIT $2`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ds := []models.ThemeDeployment{}
+	for rows.Next() {
+		var d models.ThemeDeployment
+		var rollbackOf sql.NullInt64
+		err = rows.Scan(&d.ID, &d.Store, &d.ThemeID, &d.AssetKey, &d.ContentHash, &d.TriggeredBy,
+			&rollbackOf, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.RollbackOf = rollbackOf.Int64
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+func (m *postgresDBRepo) GetThemeDeployment(id int, did int64) (models.ThemeDeployment, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, store, theme_id, asset_key, content_hash, content, previous_content,
+			 triggered_by, rollback_of, created_at
+			 FROM theme_deployment
+			 WHERE store = $1 AND id = $2`
+
+	var d models.ThemeDeployment
+	var rollbackOf sql.NullInt64
+	err := m.DB.QueryRowContext(ctx, stmt, id, did).Scan(&d.ID, &d.Store, &d.ThemeID, &d.AssetKey,
+		&d.ContentHash, &d.Content, &d.PreviousContent, &d.TriggeredBy, &rollbackOf, &d.CreatedAt)
+	if err == sql.ErrNoRows {
+		return d, false, nil
+	}
+	if err != nil {
+		return d, false, err
+	}
+	d.RollbackOf = rollbackOf.Int64
+	return d, true, nil
+}
+
+/* GetLatestThemeDeployment returns the last push of an asset, the state the theme should be in */
+func (m *postgresDBRepo) GetLatestThemeDeployment(id int, key string) (models.ThemeDeployment, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT id, store, theme_id, asset_key, content_hash, content, previous_content,
+			 triggered_by, rollback_of, created_at
+			 FROM theme_deployment
+			 WHERE store = $1 AND asset_key = $2
+			 ORDER BY created_at DESC, id DESC
+			 LIMIT 1`
+
+	var d models.ThemeDeployment
+	var rollbackOf sql.NullInt64
+	err := m.DB.QueryRowContext(ctx, stmt, id, key).Scan(&d.ID, &d.Store, &d.ThemeID, &d.AssetKey,
+		&d.ContentHash, &d.Content, &d.PreviousContent, &d.TriggeredBy, &rollbackOf, &d.CreatedAt)
+	if err == sql.ErrNoRows {
+		return d, false, nil
+	}
+	if err != nil {
+		return d, false, err
+	}
+	d.RollbackOf = rollbackOf.Int64
+	return d, true, nil
+}
+
+/* GetDeployedStores returns installed stores that have had slaash assets pushed to their theme */
+func (m *postgresDBRepo) GetDeployedStores() ([]models.Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + storeColumns + `
+			 FROM store
+			 WHERE api_token <> ''
+			 AND EXISTS (SELECT 1 FROM theme_deployment d WHERE d.store = store.id)`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stores := []models.Store{}
+	for rows.Next() {
+		j, err := scanStore(rows)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, j)
+	}
+	return stores, rows.Err()
+}
+
+/* GetInstalledStores returns every store that still has the app installed */
+func (m *postgresDBRepo) GetInstalledStores() ([]models.Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT ` + storeColumns + `
+			 FROM store
+			 WHERE api_token <> ''`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stores := []models.Store{}
+	for rows.Next() {
+		j, err := scanStore(rows)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, j)
+	}
+	return stores, rows.Err()
+}
+
+/* GetLatestCampaignStarts maps every store to the start of its newest campaign */
+func (m *postgresDBRepo) GetLatestCampaignStarts() (map[int]time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT store, max(starts_at)
+			 FROM campaign
+			 GROUP BY store`
+
+	rows, err := m.DB.QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	starts := make(map[int]time.Time)
+	for rows.Next() {
+		var id int
+		var t time.Time
+		if err = rows.Scan(&id, &t); err != nil {
+			return nil, err
+		}
+		starts[id] = t
+	}
+	return starts, rows.Err()
+}
+
+/*
+campaignMetrics computes the metrics of the store's ($1) campaigns that have
+not been frozen yet, visitors and checkouts count towards their campaign_id
+*/
+const campaignMetrics = `SELECT c.id,
+			 COALESCE(ck.discount_value, 0) AS discount_value, COALESCE(ck.gmv_value, 0) AS gmv_value,
+			 COALESCE(v.users, 0) AS users, COALESCE(v.products, 0) AS products,
+			 COALESCE(ck.gmv_value / NULLIF(ck.conversions, 0), 0) AS aov,
+			 COALESCE(v.impressions, 0) AS impressions, COALESCE(v.promo_copied, 0) AS promo_copied,
+			 COALESCE(ck.successful_redemptions, 0) AS successful_redemptions,
+			 COALESCE(ck.conversions, 0) AS conversions
+			 FROM campaign c
+			 LEFT JOIN LATERAL (
+				SELECT COUNT(DISTINCT anonymous_id) AS users, COUNT(DISTINCT product_id) AS products,
+				COUNT(*) FILTER (WHERE deal_shown) AS impressions,
+				COUNT(*) FILTER (WHERE code_copied) AS promo_copied
+				FROM visitor
+				WHERE campaign_id = c.id
+			 ) v ON true
+			 LEFT JOIN LATERAL (
+				SELECT SUM(discount_amount)::float8 AS discount_value, SUM(gmv)::float8 AS gmv_value,
+				COUNT(DISTINCT discount_code) AS successful_redemptions,
+				COUNT(DISTINCT order_id) AS conversions
+				FROM checkout
+				WHERE campaign_id = c.id
+			 ) ck ON true
+			 WHERE c.store = $1 AND c.impressions IS NULL`
+
+/*
+OpenCampaign starts the store's campaign at start and closes the one before it.
+The campaign is opened as skipped if the merchant turned the next one off. Two
+callers racing for the same start are settled by the unique (store, starts_at)
+index, the loser gets false.
+*/
+func (m *postgresDBRepo) OpenCampaign(id int, start time.Time, end time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	/* the discount settings in force are kept with the campaign */
+	var skip bool
+	var dd, dc, md sql.NullInt16
+	stmt := `SELECT skip_next_campaign, default_discount, discount_category, max_discount_for_popup
+			 FROM store
+			 WHERE id = $1
+			 FOR UPDATE`
+
+	err = tx.QueryRowContext(ctx, stmt, id).Scan(&skip, &dd, &dc, &md)
+	if err != nil {
+		return false, err
+	}
+
+	status := "open"
+	if skip {
+		status = "skipped"
+	}
+
+	stmt = `INSERT INTO campaign (store, starts_at, ends_at, status, default_discount,
+			 discount_category, max_discount, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, now(), now())
+			 ON CONFLICT (store, starts_at) DO NOTHING
+			 RETURNING id`
+
+	var cid int
+	err = tx.QueryRowContext(ctx, stmt, id, start.UTC(), end.UTC(), status, dd.Int16, dc.Int16,
+		md.Int16).Scan(&cid)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return false, err
+	}
+
+	/* a campaign left open by missed runs ends at its own end, not now */
+	stmt = `UPDATE campaign
+			SET status = CASE WHEN status = 'open' THEN 'closed' ELSE status END,
+			ends_at = LEAST(ends_at, $3), updated_at = now()
+			WHERE store = $1 AND id <> $2 AND status IN ('open', 'skipped') AND starts_at < $3`
+
+	_, err = tx.ExecContext(ctx, stmt, id, cid, start.UTC())
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return false, err
+	}
+
+	/* closed campaigns keep the metrics they ended with */
+	stmt = `UPDATE campaign
+			SET discount_value = mt.discount_value, gmv_value = mt.gmv_value, users = mt.users,
+			products = mt.products, aov = mt.aov, impressions = mt.impressions,
+			promo_copied = mt.promo_copied, successful_redemptions = mt.successful_redemptions,
+			conversions = mt.conversions
+			FROM (` + campaignMetrics + `) mt
+			WHERE campaign.id = mt.id AND campaign.status <> 'open'`
+
+	_, err = tx.ExecContext(ctx, stmt, id)
+	if err != nil {
+		m.App.ErrorLog.Println("DB insertion failed")
+		return false, err
+	}
+
+	if skip {
+		_, err = tx.ExecContext(ctx, `UPDATE store SET skip_next_campaign = false WHERE id = $1`, id)
+		if err != nil {
+			m.App.ErrorLog.Println("DB insertion failed")
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+/* GetCampaignStatus returns the status of the store's campaign running at t */
+func (m *postgresDBRepo) GetCampaignStatus(id int, t time.Time) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `SELECT status
+			 FROM campaign
+			 WHERE store = $1 AND starts_at <= $2 AND ends_at > $2
+			 ORDER BY starts_at DESC
+			 LIMIT 1`
+
+	var status string
+	err := m.DB.QueryRowContext(ctx, stmt, id, t.UTC()).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return status, true, nil
+}
+
+/* nullTime stores zero times as NULL and the others in UTC */
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
 }
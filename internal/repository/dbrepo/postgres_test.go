@@ -0,0 +1,175 @@
+package dbrepo
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/migrate"
+	"github.com/malalwan/slaash/internal/models"
+)
+
+/*
+The tests in this file run against the postgres database in TEST_DATABASE_URL
+and are skipped without it. They migrate it up and clean up the store they create.
+*/
+
+/* testPostgres migrates the test database and returns a repo on it */
+func testPostgres(t *testing.T) *postgresDBRepo {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrate.New("postgres", db, "../../../migrations/postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Up(0); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &config.AppConfig{
+		InfoLog:  log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	return &postgresDBRepo{App: app, DB: db}
+}
+
+/* testStore creates a store for one test and drops it with all its rows afterwards */
+func testStore(t *testing.T, m *postgresDBRepo) int {
+	t.Helper()
+	var id int
+	name := fmt.Sprintf("test-%d.myshopify.com", time.Now().UnixNano())
+	err := m.DB.QueryRow(`INSERT INTO store (name) VALUES ($1) RETURNING id`, name).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		m.DB.Exec(`DELETE FROM store WHERE id = $1`, id)
+		m.DB.Exec(`DELETE FROM rollup_dirty WHERE store = $1`, id)
+	})
+	return id
+}
+
+/* refreshRollups runs the rollup job until no hour is left dirty */
+func refreshRollups(t *testing.T, m *postgresDBRepo) {
+	t.Helper()
+	for {
+		n, err := m.RefreshRollups(1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+/*
+seedPeriods writes checkouts and visitors of the day before day and of day
+itself, the two days have different numbers so a copied period shows up.
+*/
+func seedPeriods(t *testing.T, m *postgresDBRepo, store int, day time.Time) {
+	t.Helper()
+	base := time.Now().UnixNano()
+	previous, current := day.AddDate(0, 0, -1), day
+
+	checkouts := []models.Checkout{
+		{Store: store, OrderID: base, LineItemID: base, ProductID: 13, GMV: 70000, DiscountAmount: 7000,
+			Timestamp: previous.Add(9*time.Hour + 15*time.Minute)},
+		{Store: store, OrderID: base + 1, LineItemID: base + 1, ProductID: 11, GMV: 100000, DiscountAmount: 10000,
+			Timestamp: current.Add(10*time.Hour + 30*time.Minute)},
+		{Store: store, OrderID: base + 1, LineItemID: base + 2, ProductID: 12, GMV: 25050, DiscountAmount: 2505,
+			Timestamp: current.Add(10*time.Hour + 30*time.Minute)},
+		{Store: store, OrderID: base + 2, LineItemID: base + 3, ProductID: 11, GMV: 50000, DiscountAmount: 5000,
+			Timestamp: current.Add(23*time.Hour + 45*time.Minute)},
+	}
+	if err := m.InsertCheckouts(checkouts); err != nil {
+		t.Fatal(err)
+	}
+
+	visitors := []models.Visitor{
+		{AnonymousID: "a", Store: store, ProductId: 13, Timestamp: previous.Add(9 * time.Hour), DealShown: true},
+		{AnonymousID: "b", Store: store, ProductId: 11, Timestamp: current.Add(10 * time.Hour), DealShown: true, CodeCopied: true},
+		{AnonymousID: "c", Store: store, ProductId: 12, Timestamp: current.Add(10 * time.Hour), DealShown: true},
+		{AnonymousID: "d", Store: store, ProductId: 11, Timestamp: current.Add(23 * time.Hour)},
+	}
+	for _, v := range visitors {
+		if _, err := m.InsertVisitor(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPeriodTotals(t *testing.T) {
+	m := testPostgres(t)
+	store := testStore(t, m)
+	day := time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC)
+	seedPeriods(t, m, store, day)
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		checkout map[string]int
+		visitor  map[string]int
+	}{
+		{
+			name: "current day",
+			from: day, to: day.AddDate(0, 0, 1),
+			checkout: map[string]int{"gmv": 175050, "discount": 17505, "conversions": 2},
+			visitor:  map[string]int{"users": 3, "products": 2, "impressions": 2, "code_copies": 1},
+		},
+		{
+			name: "previous day",
+			from: day.AddDate(0, 0, -1), to: day,
+			checkout: map[string]int{"gmv": 70000, "discount": 7000, "conversions": 1},
+			visitor:  map[string]int{"users": 1, "products": 1, "impressions": 1, "code_copies": 0},
+		},
+		{
+			name: "partial hours",
+			from: day.Add(10*time.Hour + 15*time.Minute), to: day.Add(23*time.Hour + 50*time.Minute),
+			checkout: map[string]int{"gmv": 175050, "discount": 17505, "conversions": 2},
+			visitor:  map[string]int{"users": 1, "products": 1, "impressions": 0, "code_copies": 0},
+		},
+	}
+
+	/* whole hours are read from the rollup, the edges of partial windows from the raw rows */
+	refreshRollups(t, m)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkout, err := m.GetCheckoutTotals(store, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertTotals(t, "checkout", checkout, tt.checkout)
+
+			visitor, err := m.GetVisitorTotals(store, tt.from, tt.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertTotals(t, "visitor", visitor, tt.visitor)
+		})
+	}
+}
+
+func assertTotals(t *testing.T, kind string, got map[string]int, want map[string]int) {
+	t.Helper()
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s %s = %d, want %d", kind, name, got[name], w)
+		}
+	}
+}
@@ -11,15 +11,6 @@ type DatabaseRepo interface {
 	SetTurnOffTime(id int) error
 	FetchUserByCreds(email string, pass string) (models.Users, bool, error)
 	GetCampignEndTime(id int) (time.Time, error)
-	GetAggFromCheckout(id int) (map[string][]int, error)
-	GetAggFromVisitor(id int) (map[string][]int, error)
-	GetDealDataFromCheckout(t1 time.Time, t2 time.Time, id int) (map[string][]int, error)
-	GetDealDataFromVisitor(t1 time.Time, t2 time.Time, id int) (map[string][]int, error)
-	GetSeriesDataFromCheckout(t time.Time, id int) ([]map[string]int, error)
-	GetSeriesDataFromVisitor(t time.Time, id int) ([]map[string]int, error)
-	GetTopProducts(id int) ([]int64, []int, []int, []int, error)
-	GetAggOtfByDuration(ts time.Time, id int) (map[string]int, error)
-	GetAllCampaigns(id int) ([]models.Campaign, error)
 	GetStoreByID(id int) (models.Store, error)
 	GetDefaultDiscountAndCategory(id int) (int8, int8, error)
 	GetConfiguredDiscounts(id int, cat int8) (map[int64]int8, error)
@@ -29,11 +20,72 @@ type DatabaseRepo interface {
 	UpdateDiscountDefaults(id int, def int8, cat int8) error
 	UpdateDealListConfig(id int, md int8, pc string, bs int8, bc string) error
 	UpdateUserProfile(id int, fn string, ln string, p string) error
+	InstallStore(s models.Store, owner models.Users) (int, models.Users, error)
+	GetOwnerByStoreID(id int) (models.Users, bool, error)
+	InsertUser(u models.Users) error
+	GetStoreByName(name string) (models.Store, bool, error)
+	InsertWebhookDelivery(id string, shop string, topic string) (bool, error)
+	DeleteWebhookDelivery(id string) error
+	UninstallStore(id int) error
+	GetDiscountCodeByCode(id int, code string) (models.DiscountCode, bool, error)
+	GetAnonymousIDByDiscountCode(id int, dc int64) (string, error)
+	InsertCheckouts(cs []models.Checkout) error
+	UpsertAbandonedCheckout(c models.AbandonedCheckout) error
+	GetPriceRuleForProduct(id int, cat int8, ident int64) (int64, bool, error)
+	CountPooledCodes(id int, prId int64) (int, error)
+	InsertDiscountCodes(cs []models.DiscountCode) error
+	ClaimDiscountCode(id int, prId int64, expires time.Time) (models.DiscountCode, bool, error)
+	GetExpiredDiscountCodes(limit int) ([]models.DiscountCode, error)
+	RedeemDiscountCode(sid int64) error
+	RevokeDiscountCode(sid int64) error
+	GetRetiredPriceRules(limit int) ([]models.RetiredPriceRule, error)
+	DropRetiredPriceRule(id int, prId int64) error
+	InsertVisitor(v models.Visitor) (int64, error)
+	GetOtfConfig(id int) (models.OtfConfig, bool, error)
+	UpdateOtfConfig(c models.OtfConfig) error
+	GetOtfCache(aid string, id int) (models.OtfCache, bool, error)
+	UpsertOtfCache(c models.OtfCache) error
+	TouchOtfCache(aid string, id int) error
+	GetStoreByPublicKey(key string) (models.Store, bool, error)
+	GetLiveCodeForVisitor(id int, aid string, pid int64) (models.DiscountCode, bool, error)
+	GetFunnel(id int, aid string, pid int64, since time.Time) (models.Visitor, bool, error)
+	AdvanceFunnel(vid int64, step string) (bool, error)
+	AttachCodeToVisitor(vid int64, dc int64, timer int8) (bool, error)
+	InsertThemeDeployment(d models.ThemeDeployment) (int64, error)
+	GetThemeDeployments(id int, limit int) ([]models.ThemeDeployment, error)
+	GetThemeDeployment(id int, did int64) (models.ThemeDeployment, bool, error)
+	GetLatestThemeDeployment(id int, key string) (models.ThemeDeployment, bool, error)
+	GetDeployedStores() ([]models.Store, error)
+	GetInstalledStores() ([]models.Store, error)
+	GetLatestCampaignStarts() (map[int]time.Time, error)
+	OpenCampaign(id int, start time.Time, end time.Time) (bool, error)
+	GetCampaignStatus(id int, t time.Time) (string, bool, error)
+	UpdateStoreTimezone(id int, tz string) error
+	RefreshRollups(limit int) (int, error)
+	RotateStoreTokens(after int, limit int) (int, int, error)
+	UpdatePassword(email string, pass string) error
 	// CreateStore(s models.Store) error
 	// UpdateStore(s models.Store) (models.Store, error)
 }
 
+/*
+AnalyticsRepo answers the dashboard queries over visitors and checkouts. The
+transactional rows always live in postgres, Sync copies them to the backend.
+*/
+type AnalyticsRepo interface {
+	GetCheckoutTotals(id int, from time.Time, to time.Time) (map[string]int, error)
+	GetVisitorTotals(id int, from time.Time, to time.Time) (map[string]int, error)
+	GetSeriesDataFromCheckout(q models.AnalyticsQuery, id int) ([]map[string]int, error)
+	GetSeriesDataFromVisitor(q models.AnalyticsQuery, id int) ([]map[string]int, error)
+	GetTopProducts(id int) ([]int64, []int, []int, []int, error)
+	GetAggOtfByDuration(q models.AnalyticsQuery, id int) (map[string]int, error)
+	GetAllCampaigns(id int) ([]models.Campaign, error)
+	Sync(limit int) (int, error)
+}
+
 type ClickhouseRepo interface {
 	AllUsers()
-	PullStreamByAnonymousID(id string) (models.VisitTable, error)
+	PullStreamByAnonymousID(store int, id string) (models.VisitTable, error)
+	GetLastEventTime(store int, id string) (time.Time, error)
+	InsertClickstream(es []models.ClickEvent) error
 }
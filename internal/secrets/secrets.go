@@ -0,0 +1,207 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+Values are sealed with envelope encryption: each value gets its own random data
+key, the value is encrypted with the data key and the data key with a key
+encryption key from the keyring. Both use AES-256-GCM. A sealed value reads
+
+	v1:<key id>:<wrapped data key>:<ciphertext>
+
+and is bound to a context, e.g. the row and column it is stored in, so it
+can't be copied over to another row. Rotating re-wraps the data key with the
+primary key, the ciphertext is kept.
+*/
+
+const version = "v1"
+const keySize = 32 // AES-256
+
+var keyID = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+var encoding = base64.RawURLEncoding
+
+// ErrUnknownKey is returned for values sealed with a key no longer in the keyring
+var ErrUnknownKey = errors.New("sealed with a key that is not in the keyring")
+
+// Keyring holds the key encryption keys, new values are sealed with the primary
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+/*
+NewKeyring parses keys written as <id>:<base64 of 32 bytes>. The first key is
+the primary, the others only open values sealed before a rotation.
+*/
+func NewKeyring(keys []string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for n, key := range keys {
+		id, encoded, found := strings.Cut(strings.TrimSpace(key), ":")
+		if !found || !keyID.MatchString(id) {
+			return nil, fmt.Errorf("key %d must look like <id>:<base64 key> with a lowercase alphanumeric id", n+1)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("key id %s is used twice", id)
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != keySize {
+			return nil, fmt.Errorf("key %s must be %d bytes in base64", id, keySize)
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if n == 0 {
+			k.primary = id
+		}
+	}
+	return k, nil
+}
+
+// IDs lists the key ids, the primary first, for logs
+func (k *Keyring) IDs() []string {
+	ids := []string{k.primary}
+	for id := range k.keys {
+		if id != k.primary {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Prefix starts every value sealed with the primary key
+func (k *Keyring) Prefix() string {
+	return version + ":" + k.primary + ":"
+}
+
+/* Seal encrypts plaintext for context, an empty plaintext stays empty */
+func (k *Keyring) Seal(plaintext string, context string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(plaintext), []byte(context))
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dek, ciphertext, context)
+}
+
+/*
+Open decrypts a value sealed for context. Values without the v1 prefix were
+stored before encryption and are returned as they are, until rotated.
+*/
+func (k *Keyring) Open(sealed string, context string) (string, error) {
+	if !strings.HasPrefix(sealed, version+":") {
+		return sealed, nil
+	}
+	dek, ciphertext, err := k.unwrap(sealed, context)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, ciphertext, []byte(context))
+	if err != nil {
+		return "", errors.New("can't decrypt the sealed value")
+	}
+	return string(plaintext), nil
+}
+
+/*
+Rotate returns the value sealed with the primary key. Values already sealed
+with it come back unchanged and plaintext values get sealed.
+*/
+func (k *Keyring) Rotate(sealed string, context string) (string, error) {
+	if sealed == "" || strings.HasPrefix(sealed, k.Prefix()) {
+		return sealed, nil
+	}
+	if !strings.HasPrefix(sealed, version+":") {
+		return k.Seal(sealed, context)
+	}
+	dek, ciphertext, err := k.unwrap(sealed, context)
+	if err != nil {
+		return "", err
+	}
+	return k.wrap(dek, ciphertext, context)
+}
+
+/* wrap seals the data key with the primary key and writes out the value */
+func (k *Keyring) wrap(dek []byte, ciphertext []byte, context string) (string, error) {
+	wrapped, err := seal(k.keys[k.primary], dek, []byte(k.primary+":"+context))
+	if err != nil {
+		return "", err
+	}
+	return k.Prefix() + encoding.EncodeToString(wrapped) + ":" + encoding.EncodeToString(ciphertext), nil
+}
+
+/* unwrap parses a sealed value and opens its data key */
+func (k *Keyring) unwrap(sealed string, context string) ([]byte, []byte, error) {
+	parts := strings.Split(sealed, ":")
+	if len(parts) != 4 {
+		return nil, nil, errors.New("malformed sealed value")
+	}
+	kek, found := k.keys[parts[1]]
+	if !found {
+		return nil, nil, fmt.Errorf("key %s: %w", parts[1], ErrUnknownKey)
+	}
+	wrapped, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New("malformed sealed value")
+	}
+	ciphertext, err := encoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, nil, errors.New("malformed sealed value")
+	}
+	dek, err := open(kek, wrapped, []byte(parts[1]+":"+context))
+	if err != nil || len(dek) != keySize {
+		return nil, nil, errors.New("can't unwrap the data key")
+	}
+	return dek, ciphertext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/* seal prepends a random nonce to the ciphertext */
+func seal(aead cipher.AEAD, plaintext []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func open(aead cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], ad)
+}
@@ -0,0 +1,327 @@
+package theme
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	goshopify "github.com/bold-commerce/go-shopify/v3"
+	"github.com/malalwan/slaash/internal/config"
+	"github.com/malalwan/slaash/internal/models"
+	"github.com/malalwan/slaash/internal/repository"
+)
+
+// ScriptAsset is the theme asset holding the deal list widget
+const ScriptAsset = "assets/global-slaash.js"
+
+// LayoutAsset is the theme layout the widget is included from
+const LayoutAsset = "layout/theme.liquid"
+
+/* everything between the markers in the layout belongs to us and is rewritten on deploy */
+const includeBegin = "<!-- slaash:begin -->"
+const includeEnd = "<!-- slaash:end -->"
+const include = includeBegin + "\n<script src=\"{{ 'global-slaash.js' | asset_url }}\" defer></script>\n" + includeEnd
+
+const reconcileInterval = 30 * time.Minute // how often every store's main theme is checked
+
+/* used when the merchant has not picked a colour yet */
+const defaultPopupColor = "#ffffff"
+const defaultButtonColor = "#111111"
+
+// ErrNoHead is returned when the layout has no </head> to put the script before
+var ErrNoHead = errors.New("theme layout has no </head> tag")
+
+// ErrNoDeployment is returned when rolling back a deployment the store doesn't have
+var ErrNoDeployment = errors.New("no such theme deployment")
+
+//go:embed slaash.js.tmpl
+var scriptTemplate string
+
+var script = template.Must(template.New("slaash.js").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}).Parse(scriptTemplate))
+
+var colour = regexp.MustCompile(`^#[0-9a-fA-F]{3,8}$`)
+
+/* widgetConfig is what the script gets from DlInfo, json encoded into it */
+type widgetConfig struct {
+	Version      string `json:"version"`
+	Key          string `json:"key"`
+	MaxDiscount  int8   `json:"maxDiscount"`
+	PopupColor   string `json:"popupColor"`
+	ButtonColor  string `json:"buttonColor"`
+	ButtonRadius string `json:"buttonRadius"`
+}
+
+/*
+Render builds the widget script for a store. api is the base URL of the
+storefront endpoints. The version is a hash of the config and template, so the
+same config always renders the same script.
+*/
+func Render(store models.Store, dl models.DlInfo, api string) (string, string, error) {
+	c := widgetConfig{
+		Key:          store.PublicKey,
+		MaxDiscount:  dl.MaxDiscount,
+		PopupColor:   pickColour(dl.PopupColor, defaultPopupColor),
+		ButtonColor:  pickColour(dl.ButtonColor, defaultButtonColor),
+		ButtonRadius: buttonRadius(dl.ButtonStyle),
+	}
+
+	cfg, err := json.Marshal(c)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256(append(cfg, []byte(api+scriptTemplate)...))
+	c.Version = "v" + hex.EncodeToString(sum[:])[:12]
+
+	var buf bytes.Buffer
+	err = script.Execute(&buf, struct {
+		Version string
+		Config  widgetConfig
+		API     string
+	}{c.Version, c, strings.TrimRight(api, "/")})
+	if err != nil {
+		return "", "", err
+	}
+	return buf.String(), c.Version, nil
+}
+
+/*
+IncludeScript adds the script tag to a theme layout right before </head>, or
+refreshes our block if it is already there. Returns false when nothing changed.
+*/
+func IncludeScript(layout string) (string, bool, error) {
+	begin := strings.Index(layout, includeBegin)
+	end := strings.Index(layout, includeEnd)
+	if begin >= 0 && end > begin {
+		updated := layout[:begin] + include + layout[end+len(includeEnd):]
+		return updated, updated != layout, nil
+	}
+
+	head := strings.LastIndex(strings.ToLower(layout), "</head>")
+	if head < 0 {
+		return layout, false, ErrNoHead
+	}
+	return layout[:head] + include + "\n" + layout[head:], true, nil
+}
+
+// Deployer pushes slaash assets to store themes and keeps a record of every push
+type Deployer struct {
+	App *config.AppConfig
+	DB  repository.DatabaseRepo
+}
+
+// NewDeployer creates the theme deployer
+func NewDeployer(a *config.AppConfig, db repository.DatabaseRepo) *Deployer {
+	return &Deployer{
+		App: a,
+		DB:  db,
+	}
+}
+
+/*
+Deploy renders the script, uploads it to the published theme and makes sure
+the layout includes it. by is who asked for it. Returns the deployed version.
+*/
+func (d *Deployer) Deploy(store models.Store, dl models.DlInfo, by string) (string, error) {
+	js, version, err := Render(store, dl, d.App.StorefrontURL)
+	if err != nil {
+		return "", err
+	}
+
+	themeID, err := store.MainThemeID()
+	if err != nil {
+		return "", err
+	}
+
+	/* upload the script first so the layout never points at a missing asset */
+	_, err = d.push(store, themeID, ScriptAsset, js, by, 0)
+	if err != nil {
+		return "", err
+	}
+
+	layout, err := d.current(store, themeID, LayoutAsset)
+	if err != nil {
+		return "", err
+	}
+	layout, changed, err := IncludeScript(layout)
+	if err != nil {
+		return "", err
+	}
+	if changed {
+		_, err = d.push(store, themeID, LayoutAsset, layout, by, 0)
+		if err != nil {
+			return "", err
+		}
+	}
+	return version, nil
+}
+
+/*
+Rollback puts an asset back to what it held before the given deployment. The
+rollback is a deployment too, so it can be rolled back in turn. Returns the id
+of the new deployment, 0 if the asset already held that content.
+*/
+func (d *Deployer) Rollback(store models.Store, deploymentID int64, by string) (int64, error) {
+	dep, found, err := d.DB.GetThemeDeployment(store.ID, deploymentID)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrNoDeployment
+	}
+
+	return d.push(store, dep.ThemeID, dep.AssetKey, dep.PreviousContent, by, dep.ID)
+}
+
+/*
+Reconcile makes the published theme match the last deployment of the script,
+so the widget survives the merchant publishing another theme. A layout whose
+last deployment was a rollback that took the include out is left alone. Anything
+it had to push is recorded as a deployment by by. Returns true if it fixed something.
+*/
+func (d *Deployer) Reconcile(store models.Store, by string) (bool, error) {
+	last, found, err := d.DB.GetLatestThemeDeployment(store.ID, ScriptAsset)
+	if err != nil {
+		return false, err
+	}
+	if !found || last.Content == "" {
+		/* never deployed, or rolled back to nothing on purpose */
+		return false, nil
+	}
+
+	lastLayout, found, err := d.DB.GetLatestThemeDeployment(store.ID, LayoutAsset)
+	if err != nil {
+		return false, err
+	}
+	if found && lastLayout.RollbackOf != 0 && !strings.Contains(lastLayout.Content, includeBegin) {
+		/* the merchant rolled the include back, don't put it in again */
+		return false, nil
+	}
+
+	themeID, err := store.MainThemeID()
+	if err != nil {
+		return false, err
+	}
+
+	id, err := d.push(store, themeID, ScriptAsset, last.Content, by, 0)
+	if err != nil {
+		return false, err
+	}
+	fixed := id != 0
+
+	layout, err := d.current(store, themeID, LayoutAsset)
+	if err != nil {
+		return fixed, err
+	}
+	layout, changed, err := IncludeScript(layout)
+	if err != nil {
+		return fixed, err
+	}
+	if changed {
+		_, err = d.push(store, themeID, LayoutAsset, layout, by, 0)
+		if err != nil {
+			return fixed, err
+		}
+		fixed = true
+	}
+
+	if fixed {
+		d.App.InfoLog.Println("Reinstalled deal list on theme", themeID, "of", store.Name)
+	}
+	return fixed, nil
+}
+
+// Run reconciles every deployed store periodically, it never returns
+func (d *Deployer) Run() {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stores, err := d.DB.GetDeployedStores()
+		if err != nil {
+			d.App.ErrorLog.Println("Failed to fetch stores to reconcile:", err)
+			continue
+		}
+		for _, store := range stores {
+			if _, err = d.Reconcile(store, "system:reconciler"); err != nil {
+				d.App.ErrorLog.Println("Failed to reconcile theme of", store.Name, err)
+			}
+		}
+	}
+}
+
+/*
+push writes one asset and records it with what it replaced. Pushing what is
+already there is skipped and returns 0. An empty value removes the asset.
+*/
+func (d *Deployer) push(store models.Store, themeID int64, key string, value string, by string, rollbackOf int64) (int64, error) {
+	previous, err := d.current(store, themeID, key)
+	if err != nil {
+		return 0, err
+	}
+	if previous == value {
+		return 0, nil
+	}
+
+	if value == "" {
+		err = store.DeleteThemeAsset(themeID, key)
+	} else {
+		err = store.PutThemeAsset(themeID, key, value)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha256.Sum256([]byte(value))
+	return d.DB.InsertThemeDeployment(models.ThemeDeployment{
+		Store:           store.ID,
+		ThemeID:         themeID,
+		AssetKey:        key,
+		ContentHash:     hex.EncodeToString(sum[:]),
+		Content:         value,
+		PreviousContent: previous,
+		TriggeredBy:     by,
+		RollbackOf:      rollbackOf,
+	})
+}
+
+/* current reads an asset from the theme, a missing asset reads as empty */
+func (d *Deployer) current(store models.Store, themeID int64, key string) (string, error) {
+	value, err := store.GetThemeAsset(themeID, key)
+	var respErr goshopify.ResponseError
+	if errors.As(err, &respErr) && respErr.Status == http.StatusNotFound {
+		return "", nil
+	}
+	return value, err
+}
+
+/* pickColour only lets hex colours into the script */
+func pickColour(c string, def string) string {
+	if colour.MatchString(c) {
+		return c
+	}
+	return def
+}
+
+/* buttonRadius maps ButtonStyle, 1 is square, 2 is pill, anything else rounded */
+func buttonRadius(style int8) string {
+	switch style {
+	case 1:
+		return "border-radius:0;"
+	case 2:
+		return "border-radius:999px;"
+	}
+	return "border-radius:6px;"
+}
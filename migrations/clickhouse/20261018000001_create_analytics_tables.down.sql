@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS Checkout;
+DROP TABLE IF EXISTS Visitor;
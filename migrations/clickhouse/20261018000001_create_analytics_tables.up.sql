@@ -0,0 +1,41 @@
+-- Copies of postgres visitor and checkout rows for the clickhouse analytics
+-- repo, kept up to date by its Sync. A row is copied again whenever it
+-- changes, the copy with the latest changed_at wins.
+
+CREATE TABLE IF NOT EXISTS Visitor
+(
+    id Int64,
+    store Int32,
+    anonymous_id String,
+    product_id Int64,
+    campaign_id Int32,
+    timestamp DateTime64(6, 'UTC'),
+    deal_shown Bool,
+    deal_clicked Bool,
+    code_shown Bool,
+    code_copied Bool,
+    discount_code Int64,
+    changed_at DateTime64(6, 'UTC')
+)
+ENGINE = ReplacingMergeTree(changed_at)
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (store, timestamp, id);
+
+CREATE TABLE IF NOT EXISTS Checkout
+(
+    id Int64,
+    store Int32,
+    anonymous_id String,
+    order_id Int64,
+    line_item_id Int64,
+    product_id Int64,
+    campaign_id Int32,
+    gmv Int64,
+    discount_amount Int64,
+    discount_code Int64,
+    timestamp DateTime64(6, 'UTC'),
+    changed_at DateTime64(6, 'UTC')
+)
+ENGINE = ReplacingMergeTree(changed_at)
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (store, timestamp, id);
@@ -0,0 +1,14 @@
+-- Events posted to /storefront/collect. properties is a JSON string, see
+-- internal/collect for the events and properties accepted. A batch retried
+-- from the disk queue keeps its uuids, so the copies merge away.
+
+CREATE TABLE IF NOT EXISTS Clickstream
+(
+    uuid UUID,
+    event LowCardinality(String),
+    properties String,
+    timestamp DateTime64(6, 'UTC')
+)
+ENGINE = ReplacingMergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (timestamp, uuid);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS Clickstream_unkeyed
+(
+    uuid UUID,
+    event LowCardinality(String),
+    properties String,
+    timestamp DateTime64(6, 'UTC')
+)
+ENGINE = ReplacingMergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (timestamp, uuid);
+
+INSERT INTO Clickstream_unkeyed (uuid, event, properties, timestamp)
+SELECT uuid, event, properties, timestamp
+FROM Clickstream;
+
+RENAME TABLE Clickstream TO Clickstream_keyed, Clickstream_unkeyed TO Clickstream;
+
+DROP TABLE IF EXISTS Clickstream_keyed;
@@ -0,0 +1,28 @@
+-- Clickstream rows carry the store that sent them and the visitor's device id,
+-- and are sorted by both so a visitor's events are read without a full scan.
+-- The sorting key can't be changed in place, the rows are copied to a new
+-- table. Events from before have no store, they get store 0 here as ClickHouse
+-- can't read the stores from postgres. Run `go run ./cmd/migrate
+-- backfill-clickstream` after this migration to move them to their store by
+-- their host, until then they don't count towards OTF scores.
+
+CREATE TABLE IF NOT EXISTS Clickstream_keyed
+(
+    uuid UUID,
+    store Int32,
+    device_id String,
+    event LowCardinality(String),
+    properties String,
+    timestamp DateTime64(6, 'UTC')
+)
+ENGINE = ReplacingMergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (store, device_id, timestamp, uuid);
+
+INSERT INTO Clickstream_keyed (uuid, store, device_id, event, properties, timestamp)
+SELECT uuid, 0, JSONExtractString(properties, '$device_id'), event, properties, timestamp
+FROM Clickstream;
+
+RENAME TABLE Clickstream TO Clickstream_unkeyed, Clickstream_keyed TO Clickstream;
+
+DROP TABLE IF EXISTS Clickstream_unkeyed;
@@ -0,0 +1,41 @@
+CREATE TABLE store (
+    id serial PRIMARY KEY,
+    name varchar(255) NOT NULL,
+    api_token varchar(255) NOT NULL DEFAULT '',
+    refresh_token varchar(255) NOT NULL DEFAULT '',
+    misc text NOT NULL DEFAULT '',
+    url varchar(255) NOT NULL DEFAULT '',
+    currency varchar(8) NOT NULL DEFAULT '',
+    timezone varchar(64) NOT NULL DEFAULT 'UTC',
+    public_key varchar(64),
+    popup_color_code varchar(16) NOT NULL DEFAULT '',
+    button_color_code varchar(16) NOT NULL DEFAULT '',
+    button_style smallint NOT NULL DEFAULT 0,
+    max_discount_for_popup smallint NOT NULL DEFAULT 0,
+    default_discount smallint NOT NULL DEFAULT 0,
+    discount_category smallint NOT NULL DEFAULT 0,
+    deal_list_active boolean NOT NULL DEFAULT false,
+    campaign_renewal_time time,
+    campaign_turn_off_time time,
+    skip_next_campaign boolean NOT NULL DEFAULT false
+);
+
+CREATE UNIQUE INDEX store_name_idx ON store (name);
+CREATE UNIQUE INDEX store_public_key_idx ON store (public_key);
+
+CREATE TABLE users (
+    id serial PRIMARY KEY,
+    first_name varchar(255) NOT NULL DEFAULT '',
+    last_name varchar(255) NOT NULL DEFAULT '',
+    email varchar(255) NOT NULL,
+    password varchar(60) NOT NULL DEFAULT '',
+    access_level integer NOT NULL DEFAULT 1,
+    store integer REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    photo varchar(2048) NOT NULL DEFAULT '',
+    misc text NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL
+);
+
+CREATE UNIQUE INDEX users_email_idx ON users (email);
+CREATE INDEX users_store_idx ON users (store);
@@ -0,0 +1,3 @@
+DROP TABLE collection;
+DROP TABLE product;
+DROP TABLE discount_code;
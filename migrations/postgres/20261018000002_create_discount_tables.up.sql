@@ -0,0 +1,39 @@
+-- discount_code holds every code created on shopify, pooled ones are handed
+-- out to visitors. product and collection hold the configured discounts, each
+-- pointing at the code of its price rule.
+
+CREATE TABLE discount_code (
+    shopify_id bigint PRIMARY KEY,
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    price_rule_id bigint NOT NULL,
+    code varchar(255) NOT NULL,
+    timestamp timestamp NOT NULL,
+    pooled boolean NOT NULL DEFAULT false,
+    issued_at timestamp,
+    expires_at timestamp,
+    redeemed_at timestamp,
+    revoked_at timestamp
+);
+
+CREATE INDEX discount_code_store_price_rule_id_idx ON discount_code (store, price_rule_id);
+CREATE INDEX discount_code_store_price_rule_id_issued_at_idx ON discount_code (store, price_rule_id, issued_at);
+CREATE INDEX discount_code_store_code_idx ON discount_code (store, lower(code));
+CREATE INDEX discount_code_expires_at_idx ON discount_code (expires_at);
+
+CREATE TABLE product (
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    product_id bigint NOT NULL,
+    discount_percentage smallint NOT NULL DEFAULT 0,
+    discount_code bigint,
+    impressions bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (store, product_id)
+);
+
+CREATE TABLE collection (
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    collection_id bigint NOT NULL,
+    discount_percentage smallint NOT NULL DEFAULT 0,
+    discount_code bigint,
+    impressions bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (store, collection_id)
+);
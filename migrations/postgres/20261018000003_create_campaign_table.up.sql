@@ -0,0 +1,26 @@
+-- One row per store per day. The discount settings are copied in when the
+-- campaign opens and the metrics are frozen when it closes.
+
+CREATE TABLE campaign (
+    id serial PRIMARY KEY,
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    starts_at timestamp NOT NULL,
+    ends_at timestamp NOT NULL,
+    status varchar(16) NOT NULL,
+    default_discount smallint NOT NULL DEFAULT 0,
+    discount_category smallint NOT NULL DEFAULT 0,
+    max_discount smallint NOT NULL DEFAULT 0,
+    discount_value double precision,
+    gmv_value double precision,
+    users integer,
+    products integer,
+    aov double precision,
+    impressions bigint,
+    promo_copied bigint,
+    successful_redemptions bigint,
+    conversions bigint,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL
+);
+
+CREATE UNIQUE INDEX campaign_store_starts_at_idx ON campaign (store, starts_at);
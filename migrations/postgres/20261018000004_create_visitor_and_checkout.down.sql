@@ -0,0 +1,3 @@
+DROP TABLE checkout;
+DROP TABLE visitor;
+DROP FUNCTION mark_changed();
@@ -0,0 +1,63 @@
+-- visitor has one row per deal list funnel, checkout one row per line item
+-- bought with a slaash code. Both are stored in UTC. changed_at is set on
+-- every write so the clickhouse analytics can copy what changed.
+
+CREATE TABLE visitor (
+    id bigserial PRIMARY KEY,
+    anonymous_id varchar(255) NOT NULL,
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    product_id bigint NOT NULL,
+    campaign_id integer REFERENCES campaign (id) ON DELETE SET NULL ON UPDATE CASCADE,
+    timestamp timestamp NOT NULL,
+    discount_code bigint,
+    timer_in_minutes smallint NOT NULL DEFAULT 0,
+    deal_shown boolean NOT NULL DEFAULT false,
+    deal_clicked boolean NOT NULL DEFAULT false,
+    code_shown boolean NOT NULL DEFAULT false,
+    code_copied boolean NOT NULL DEFAULT false,
+    deal_shown_at timestamp,
+    deal_clicked_at timestamp,
+    code_shown_at timestamp,
+    code_copied_at timestamp,
+    misc text NOT NULL DEFAULT '',
+    changed_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+);
+
+CREATE INDEX visitor_store_timestamp_idx ON visitor (store, timestamp);
+CREATE INDEX visitor_store_anonymous_id_product_id_timestamp_idx ON visitor (store, anonymous_id, product_id, timestamp);
+CREATE INDEX visitor_store_discount_code_idx ON visitor (store, discount_code);
+CREATE INDEX visitor_campaign_id_idx ON visitor (campaign_id);
+CREATE INDEX visitor_changed_at_id_idx ON visitor (changed_at, id);
+
+CREATE TABLE checkout (
+    id bigserial PRIMARY KEY,
+    anonymous_id varchar(255) NOT NULL DEFAULT '',
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    order_id bigint NOT NULL DEFAULT 0,
+    line_item_id bigint,
+    product_id bigint NOT NULL,
+    campaign_id integer REFERENCES campaign (id) ON DELETE SET NULL ON UPDATE CASCADE,
+    gmv integer NOT NULL DEFAULT 0,
+    discount_amount integer NOT NULL DEFAULT 0,
+    discount_code bigint,
+    timestamp timestamp NOT NULL,
+    changed_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC')
+);
+
+CREATE UNIQUE INDEX checkout_line_item_id_idx ON checkout (line_item_id);
+CREATE INDEX checkout_store_timestamp_idx ON checkout (store, timestamp);
+CREATE INDEX checkout_store_product_id_idx ON checkout (store, product_id);
+CREATE INDEX checkout_campaign_id_idx ON checkout (campaign_id);
+CREATE INDEX checkout_changed_at_id_idx ON checkout (changed_at, id);
+
+CREATE FUNCTION mark_changed() RETURNS trigger AS $$
+BEGIN
+  NEW.changed_at = clock_timestamp() AT TIME ZONE 'UTC';
+  RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER visitor_changed BEFORE INSERT OR UPDATE ON visitor
+FOR EACH ROW EXECUTE FUNCTION mark_changed();
+CREATE TRIGGER checkout_changed BEFORE INSERT OR UPDATE ON checkout
+FOR EACH ROW EXECUTE FUNCTION mark_changed();
@@ -0,0 +1,5 @@
+DROP TRIGGER checkout_rollup_dirty ON checkout;
+DROP TRIGGER visitor_rollup_dirty ON visitor;
+DROP FUNCTION mark_rollup_dirty();
+DROP TABLE rollup_dirty;
+DROP TABLE hourly_rollup;
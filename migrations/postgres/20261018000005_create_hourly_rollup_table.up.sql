@@ -0,0 +1,43 @@
+-- hourly_rollup has the dashboard metrics of each store per UTC hour. Writes
+-- to visitor and checkout mark their hour in rollup_dirty and the rollup job
+-- recomputes the marked hours.
+
+CREATE TABLE hourly_rollup (
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    hour timestamp NOT NULL,
+    gmv bigint NOT NULL DEFAULT 0,
+    discount bigint NOT NULL DEFAULT 0,
+    users integer NOT NULL DEFAULT 0,
+    product_ids bigint[] NOT NULL DEFAULT '{}',
+    impressions integer NOT NULL DEFAULT 0,
+    code_copies integer NOT NULL DEFAULT 0,
+    conversions integer NOT NULL DEFAULT 0,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    PRIMARY KEY (store, hour)
+);
+
+CREATE TABLE rollup_dirty (
+    store integer NOT NULL,
+    hour timestamp NOT NULL,
+    PRIMARY KEY (store, hour)
+);
+
+CREATE FUNCTION mark_rollup_dirty() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP <> 'INSERT' THEN
+    INSERT INTO rollup_dirty (store, hour) VALUES (OLD.store, date_trunc('hour', OLD.timestamp))
+    ON CONFLICT DO NOTHING;
+  END IF;
+  IF TG_OP <> 'DELETE' THEN
+    INSERT INTO rollup_dirty (store, hour) VALUES (NEW.store, date_trunc('hour', NEW.timestamp))
+    ON CONFLICT DO NOTHING;
+  END IF;
+  RETURN NULL;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER visitor_rollup_dirty AFTER INSERT OR UPDATE OR DELETE ON visitor
+FOR EACH ROW EXECUTE FUNCTION mark_rollup_dirty();
+CREATE TRIGGER checkout_rollup_dirty AFTER INSERT OR UPDATE OR DELETE ON checkout
+FOR EACH ROW EXECUTE FUNCTION mark_rollup_dirty();
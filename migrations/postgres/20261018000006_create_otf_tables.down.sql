@@ -0,0 +1,2 @@
+DROP TABLE visit_table;
+DROP TABLE otf_config;
@@ -0,0 +1,24 @@
+-- otf_config is the OTF scoring setup of a store, visit_table the last
+-- verdict computed for each of its visitors.
+
+CREATE TABLE otf_config (
+    store integer PRIMARY KEY REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    threshold double precision NOT NULL DEFAULT 0.5,
+    weights jsonb NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL
+);
+
+CREATE TABLE visit_table (
+    anonymous_id varchar(255) NOT NULL,
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    visit jsonb NOT NULL,
+    score double precision NOT NULL DEFAULT 0,
+    threshold double precision NOT NULL DEFAULT 0,
+    otf boolean NOT NULL DEFAULT false,
+    contributions jsonb NOT NULL,
+    last_event_at timestamp,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    PRIMARY KEY (anonymous_id, store)
+);
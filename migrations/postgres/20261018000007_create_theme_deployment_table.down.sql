@@ -0,0 +1 @@
+DROP TABLE theme_deployment;
@@ -0,0 +1,15 @@
+CREATE TABLE theme_deployment (
+    id serial PRIMARY KEY,
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    theme_id bigint NOT NULL,
+    asset_key varchar(255) NOT NULL,
+    content_hash varchar(64) NOT NULL,
+    content text NOT NULL,
+    previous_content text NOT NULL,
+    triggered_by varchar(255) NOT NULL,
+    rollback_of bigint,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL
+);
+
+CREATE INDEX theme_deployment_store_created_at_idx ON theme_deployment (store, created_at);
@@ -0,0 +1,9 @@
+-- webhook_delivery remembers shopify webhook ids so redeliveries are ignored
+
+CREATE TABLE webhook_delivery (
+    webhook_id varchar(255) PRIMARY KEY,
+    shop varchar(255) NOT NULL,
+    topic varchar(255) NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL
+);
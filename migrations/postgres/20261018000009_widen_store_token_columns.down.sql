@@ -0,0 +1,2 @@
+ALTER TABLE store ALTER COLUMN api_token TYPE varchar(255);
+ALTER TABLE store ALTER COLUMN refresh_token TYPE varchar(255);
@@ -0,0 +1,4 @@
+-- Tokens are stored sealed (see internal/secrets), which is several times
+-- longer than the plain token.
+ALTER TABLE store ALTER COLUMN api_token TYPE text;
+ALTER TABLE store ALTER COLUMN refresh_token TYPE text;
@@ -0,0 +1 @@
+ALTER TABLE store DROP COLUMN owner;
@@ -0,0 +1,6 @@
+-- A merchant with several stores has one user, store.owner links each store
+-- to it. users.store stays the store the user signed up with.
+ALTER TABLE store ADD COLUMN owner integer REFERENCES users (id) ON DELETE SET NULL;
+
+UPDATE store s
+SET owner = (SELECT u.id FROM users u WHERE u.store = s.id ORDER BY u.created_at LIMIT 1);
@@ -0,0 +1,9 @@
+UPDATE campaign
+SET discount_value = discount_value / 100, gmv_value = gmv_value / 100, aov = aov / 100
+WHERE status <> 'open';
+
+UPDATE hourly_rollup SET gmv = gmv / 100, discount = discount / 100;
+
+UPDATE checkout SET gmv = gmv / 100, discount_amount = discount_amount / 100;
+ALTER TABLE checkout ALTER COLUMN gmv TYPE integer;
+ALTER TABLE checkout ALTER COLUMN discount_amount TYPE integer;
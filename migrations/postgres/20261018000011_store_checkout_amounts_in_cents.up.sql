@@ -0,0 +1,12 @@
+-- Checkout amounts were rounded to whole currency units, they are hundredths
+-- of the store currency from now on. Existing rows are scaled up, the update
+-- marks them for the clickhouse sync and the rollup job.
+ALTER TABLE checkout ALTER COLUMN gmv TYPE bigint;
+ALTER TABLE checkout ALTER COLUMN discount_amount TYPE bigint;
+UPDATE checkout SET gmv = gmv * 100, discount_amount = discount_amount * 100;
+
+UPDATE hourly_rollup SET gmv = gmv * 100, discount = discount * 100;
+
+UPDATE campaign
+SET discount_value = discount_value * 100, gmv_value = gmv_value * 100, aov = aov * 100
+WHERE status <> 'open';
@@ -0,0 +1,7 @@
+-- The shared codes are gone from shopify, the columns come back empty and
+-- the next save of the discounts creates new price rules with shared codes.
+ALTER TABLE product ADD COLUMN discount_code bigint;
+ALTER TABLE collection ADD COLUMN discount_code bigint;
+
+ALTER TABLE product DROP COLUMN price_rule_id;
+ALTER TABLE collection DROP COLUMN price_rule_id;
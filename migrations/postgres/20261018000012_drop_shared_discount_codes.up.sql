@@ -0,0 +1,19 @@
+-- Visitors only ever get single use codes from the pool, so product and
+-- collection point at their price rule instead of a shared code. The shared
+-- codes are expired here and revoked on shopify by the code reaper.
+ALTER TABLE product ADD COLUMN price_rule_id bigint;
+ALTER TABLE collection ADD COLUMN price_rule_id bigint;
+
+UPDATE product p SET price_rule_id = d.price_rule_id
+FROM discount_code d
+WHERE d.shopify_id = p.discount_code AND d.store = p.store;
+
+UPDATE collection c SET price_rule_id = d.price_rule_id
+FROM discount_code d
+WHERE d.shopify_id = c.discount_code AND d.store = c.store;
+
+UPDATE discount_code SET expires_at = now() AT TIME ZONE 'UTC'
+WHERE NOT pooled AND revoked_at IS NULL;
+
+ALTER TABLE product DROP COLUMN discount_code;
+ALTER TABLE collection DROP COLUMN discount_code;
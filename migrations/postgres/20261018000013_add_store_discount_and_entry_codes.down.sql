@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS retired_price_rule;
+
+ALTER TABLE product DROP COLUMN discount_code;
+ALTER TABLE collection DROP COLUMN discount_code;
+
+DROP TABLE IF EXISTS store_discount;
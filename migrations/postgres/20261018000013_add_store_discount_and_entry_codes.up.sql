@@ -0,0 +1,21 @@
+-- Category 1 discounts the whole store under one price rule, store_discount
+-- points at it the way product and collection point at theirs. Every
+-- configured discount keeps its own code again, visitors still only get
+-- single use codes from the pool. Price rules of removed discounts wait in
+-- retired_price_rule until shopify has deleted them.
+CREATE TABLE store_discount (
+    store integer PRIMARY KEY REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    discount_percentage smallint NOT NULL DEFAULT 0,
+    price_rule_id bigint,
+    discount_code bigint
+);
+
+ALTER TABLE product ADD COLUMN discount_code bigint;
+ALTER TABLE collection ADD COLUMN discount_code bigint;
+
+CREATE TABLE retired_price_rule (
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    price_rule_id bigint NOT NULL,
+    retired_at timestamp NOT NULL DEFAULT (now() AT TIME ZONE 'UTC'),
+    PRIMARY KEY (store, price_rule_id)
+);
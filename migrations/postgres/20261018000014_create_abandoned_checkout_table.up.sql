@@ -0,0 +1,16 @@
+-- abandoned_checkout keeps the latest state of every shopify checkout that
+-- carries a Slaash code, from the checkouts/update webhook. A checkout without
+-- completed_at was left before paying. Amounts are in cents like checkout.
+CREATE TABLE abandoned_checkout (
+    store integer NOT NULL REFERENCES store (id) ON DELETE CASCADE ON UPDATE CASCADE,
+    checkout_id bigint NOT NULL,
+    anonymous_id varchar(255) NOT NULL DEFAULT '',
+    discount_code bigint NOT NULL,
+    total_price bigint NOT NULL DEFAULT 0,
+    total_discounts bigint NOT NULL DEFAULT 0,
+    completed_at timestamp,
+    updated_at timestamp NOT NULL,
+    PRIMARY KEY (store, checkout_id)
+);
+
+CREATE INDEX abandoned_checkout_store_updated_at_idx ON abandoned_checkout (store, updated_at);